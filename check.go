@@ -0,0 +1,303 @@
+package goemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fswatcher/fswatcher"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError is the error in the configuration file
+type ConfigError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ConfigError) Error() string {
+	switch {
+	case e.Line == 0:
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	case e.Column == 0:
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// Check validate the configuration file strictly. It rejects unknown
+// fields, and validates the patterns, the operations and the internal
+// commands. The errors are *ConfigError sorted by the position.
+func Check(file string) []error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return []error{err}
+	}
+	c := &checker{file: file}
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		c.yamlError(err)
+		return c.errors()
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	doc := root.Content[0]
+	c.fields(doc, reflect.TypeOf(conf{}))
+	var cf conf
+	if err := doc.Decode(&cf); err != nil {
+		c.yamlError(err)
+		return c.errors()
+	}
+	c.conf(doc, &cf)
+	return c.errors()
+}
+
+// checker collect the errors of the configuration
+type checker struct {
+	file string
+	errs []*ConfigError
+}
+
+func (c *checker) errorf(n *yaml.Node, format string, args ...interface{}) {
+	e := &ConfigError{File: c.file, Msg: fmt.Sprintf(format, args...)}
+	if n != nil {
+		e.Line, e.Column = n.Line, n.Column
+	}
+	c.errs = append(c.errs, e)
+}
+
+func (c *checker) errors() []error {
+	sort.SliceStable(c.errs, func(i, j int) bool {
+		if c.errs[i].Line != c.errs[j].Line {
+			return c.errs[i].Line < c.errs[j].Line
+		}
+		return c.errs[i].Column < c.errs[j].Column
+	})
+	var errs []error
+	for _, e := range c.errs {
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlError add the errors of yaml which have only the line number
+func (c *checker) yamlError(err error) {
+	msgs := []string{err.Error()}
+	if te, ok := err.(*yaml.TypeError); ok {
+		msgs = te.Errors
+	}
+	for _, msg := range msgs {
+		e := &ConfigError{File: c.file, Msg: msg}
+		if m := yamlLineRe.FindStringSubmatch(strings.TrimSpace(msg)); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Msg = m[2]
+		}
+		c.errs = append(c.errs, e)
+	}
+}
+
+// yamlUnmarshaler is the type which decodes itself
+type yamlUnmarshaler interface {
+	UnmarshalYAML(unmarshal func(interface{}) error) error
+}
+
+// fields report the keys which are not the fields of t
+func (c *checker) fields(n *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(reflect.TypeOf((*yamlUnmarshaler)(nil)).Elem()) {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		keys := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			ft, ok := keys[n.Content[i].Value]
+			if !ok {
+				c.errorf(n.Content[i], "unknown field %q", n.Content[i].Value)
+				continue
+			}
+			c.fields(n.Content[i+1], ft)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 1; i < len(n.Content); i += 2 {
+			c.fields(n.Content[i], t.Elem())
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, item := range n.Content {
+			c.fields(item, t.Elem())
+		}
+	}
+}
+
+// yamlFields return the keys of the struct as yaml decodes them
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	keys := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if len(tag) > 1 && tag[1] == "inline" {
+			for k, ft := range yamlFields(f.Type) {
+				keys[k] = ft
+			}
+			continue
+		}
+		if f.PkgPath != "" || tag[0] == "-" {
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		keys[name] = f.Type
+	}
+	return keys
+}
+
+// value return the node of the key in the mapping
+func value(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// scalars return the scalar nodes of the scalar or the sequence
+func scalars(n *yaml.Node) []*yaml.Node {
+	if n == nil {
+		return nil
+	}
+	if n.Kind == yaml.SequenceNode {
+		return n.Content
+	}
+	return []*yaml.Node{n}
+}
+
+func (c *checker) conf(doc *yaml.Node, cf *conf) {
+	c.probe(value(doc, "ready"), &cf.Ready)
+	c.stopPolicy(doc, &cf.stopPolicy)
+	c.restartPolicy(doc, &cf.restartPolicy)
+	if n := value(doc, "socket"); n != nil && cf.Ready.TCP == "" && cf.Ready.HTTP == "" && cf.Ready.Log == "" {
+		c.errorf(n, "socket requires ready probe")
+	}
+	if n := value(doc, "watcher"); n != nil {
+		switch cf.Watcher {
+		case "", "notify", "poll":
+		default:
+			c.errorf(n, "unknown watcher %q", cf.Watcher)
+		}
+	}
+
+	tasks := value(doc, "tasks")
+	for i, t := range cf.Tasks {
+		if tasks == nil || i >= len(tasks.Content) {
+			break
+		}
+		c.task(tasks.Content[i], t)
+	}
+
+	procs := value(doc, "processes")
+	for name, p := range cf.Processes {
+		n := value(procs, name)
+		c.probe(value(n, "ready"), &p.Ready)
+		c.stopPolicy(n, &p.stopPolicy)
+		c.restartPolicy(n, &p.restartPolicy)
+	}
+	if _, err := sortProcesses(cf.Processes); err != nil {
+		c.errorf(procs, "%v", err)
+	}
+}
+
+func (c *checker) task(n *yaml.Node, t *task) {
+	if len(t.Match) == 0 {
+		c.errorf(n, "missing match")
+	}
+	for _, key := range []string{"match", "ignore"} {
+		w := &wildcard{}
+		valid := true
+		for _, p := range scalars(value(n, key)) {
+			if strings.HasPrefix(p.Value, ":") {
+				continue
+			}
+			pw, err := compilePatternIn(p.Value, t.Dir)
+			if err != nil {
+				c.errorf(p, "%v", err)
+				valid = false
+				continue
+			}
+			w.src = strings.TrimPrefix(w.src+"|"+p.Value, "|")
+			w.include = append(w.include, pw.include...)
+			w.exclude = append(w.exclude, pw.exclude...)
+		}
+		if err := w.check(); valid && err != nil {
+			c.errorf(value(n, key), "%v", err)
+		}
+	}
+	for _, op := range scalars(value(n, "ops")) {
+		switch strings.ToUpper(op.Value) {
+		case fswatcher.Create.String(), fswatcher.Write.String(), fswatcher.Remove.String(), fswatcher.Rename.String(), fswatcher.Chmod.String():
+		default:
+			c.errorf(op, "unknown operation %q", op.Value)
+		}
+	}
+	switch t.OnBusy {
+	case "", "drop", "queue", "restart":
+	default:
+		c.errorf(value(n, "on_busy"), "unknown on_busy policy %q", t.OnBusy)
+	}
+	for _, command := range scalars(value(n, "commands")) {
+		if !commandRe.MatchString(command.Value) {
+			continue
+		}
+		if err := checkCommand(command.Value); err != nil {
+			c.errorf(command, "%v", err)
+		}
+	}
+}
+
+func (c *checker) probe(n *yaml.Node, p *probe) {
+	if err := p.compile(); err != nil {
+		c.errorf(value(n, "log"), "%v", err)
+	}
+}
+
+func (c *checker) stopPolicy(n *yaml.Node, sp *stopPolicy) {
+	if sp.StopSignal == "" {
+		return
+	}
+	if _, err := parseSignal(sp.StopSignal); err != nil {
+		c.errorf(value(n, "stop_signal"), "%v", err)
+	}
+}
+
+func (c *checker) restartPolicy(n *yaml.Node, rp *restartPolicy) {
+	switch rp.RestartPolicy {
+	case "", "always", "never", "on-failure":
+	default:
+		c.errorf(value(n, "restart_policy"), "unknown restart_policy %q", rp.RestartPolicy)
+	}
+}
@@ -27,6 +27,10 @@ func usage() {
 	fmt.Printf("Usage of %s [options] [command] [args...]\n", os.Args[0])
 	fmt.Println(" goemon -g [NAME]     : generate default configuration")
 	fmt.Println(" goemon -c [FILE] ... : set configuration file")
+	fmt.Println(" goemon -a [ADDR] ... : start web server with livereload script")
+	fmt.Println(" goemon -A [ADDR] ... : start web server without livereload script")
+	fmt.Println(" goemon -p ...        : watch files by polling")
+	fmt.Println(" goemon -check [FILE] : check configuration file")
 	fmt.Println("")
 	fmt.Println("* Examples:")
 	fmt.Println("  Generate default configuration:")
@@ -85,6 +89,8 @@ func main() {
 	file := ""
 	args := []string{}
 	addr := ""
+	inject := true
+	watcher := ""
 
 	switch len(os.Args) {
 	case 1:
@@ -109,27 +115,52 @@ func main() {
 				usage()
 			}
 			return
-		case "-a":
-			if len(os.Args) == 2 {
+		case "-check":
+			file = "goemon.yml"
+			if len(os.Args) > 2 {
+				file = os.Args[2]
+			}
+			errs := goemon.Check(file)
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if len(errs) > 0 {
+				os.Exit(1)
+			}
+			fmt.Println(file + ": ok")
+			return
+		case "-v":
+			fmt.Printf("%s %s (rev: %s/%s)\n", name, version, revision, runtime.Version())
+			os.Exit(1)
+		}
+	}
+
+	// the options can be combined like -c FILE -p -- command
+	args = os.Args[1:]
+options:
+	for len(args) > 0 {
+		switch args[0] {
+		case "-p":
+			watcher = "poll"
+			args = args[1:]
+		case "-a", "-A":
+			if len(args) == 1 {
 				usage()
-				return
 			}
-			addr = os.Args[2]
-			args = os.Args[3:]
+			addr = args[1]
+			inject = args[0] == "-a"
+			args = args[2:]
 		case "-c":
-			if len(os.Args) == 2 {
+			if len(args) == 1 {
 				usage()
-				return
 			}
-			file = os.Args[2]
-			args = os.Args[3:]
+			file = args[1]
+			args = args[2:]
 		case "--":
-			args = os.Args[2:]
-		case "-v":
-			fmt.Printf("%s %s (rev: %s/%s)\n", name, version, revision, runtime.Version())
-			os.Exit(1)
+			args = args[1:]
+			break options
 		default:
-			args = os.Args[1:]
+			break options
 		}
 	}
 
@@ -137,10 +168,15 @@ func main() {
 	if file != "" {
 		g.File = file
 	}
+	g.Watcher = watcher
 	g.Run()
 	if len(args) == 0 {
 		if addr != "" {
-			http.Handle("/", http.FileServer(http.Dir(".")))
+			var h http.Handler = http.FileServer(http.Dir("."))
+			if inject {
+				h = g.InjectLiveReload(h)
+			}
+			http.Handle("/", h)
 			http.ListenAndServe(addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				g.Logger.Printf("%s %s %s", r.RemoteAddr, r.Method, r.URL)
 				http.DefaultServeMux.ServeHTTP(w, r)
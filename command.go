@@ -1,6 +1,12 @@
 package goemon
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -10,7 +16,9 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fswatcher/fswatcher"
 	"github.com/omeid/jsmin"
@@ -19,65 +27,385 @@ import (
 	"github.com/tdewolff/minify/css"
 )
 
-func (g *Goemon) internalCommand(command, file string) bool {
+// builtin is the internal command. check validate the arguments, and it is
+// used by both of goemon -check and internalCommand before run.
+type builtin struct {
+	check func(command string, args []string) error
+	run   func(g *Goemon, j *job, command string, args []string) bool
+}
+
+// builtins is the internal commands by name
+var builtins map[string]*builtin
+
+func init() {
+	builtins = map[string]*builtin{
+		":livereload":     {check: anyArgs, run: (*Goemon).liveReloadCommand},
+		":livereload-css": {check: anyArgs, run: (*Goemon).liveReloadCSSCommand},
+		":sleep":          {check: intArgs, run: (*Goemon).sleepCommand},
+		":fizzbuzz":       {check: intArgs, run: (*Goemon).fizzBuzzCommand},
+		":minify":         {check: anyArgs, run: (*Goemon).minifyCommand},
+		":restart!": {check: anyArgs, run: func(g *Goemon, j *job, command string, args []string) bool {
+			return g.restartCommand(os.Kill, j, args)
+		}},
+		":restart": {check: anyArgs, run: func(g *Goemon, j *job, command string, args []string) bool {
+			return g.restartCommand(nil, j, args)
+		}},
+		":restart-if-changed": {check: fileArg, run: func(g *Goemon, j *job, command string, args []string) bool {
+			return g.restartIfChangedCommand(j, args[0])
+		}},
+		":gobuild": {check: goBuildArgs, run: func(g *Goemon, j *job, command string, args []string) bool {
+			return g.goBuildCommand(j, args)
+		}},
+		":gotest": {check: anyArgs, run: func(g *Goemon, j *job, command string, args []string) bool {
+			return g.goTestCommand(j, args)
+		}},
+		":stop": {check: anyArgs, run: func(g *Goemon, j *job, command string, args []string) bool {
+			return g.processCommand(":stop", nil, args)
+		}},
+		":start": {check: anyArgs, run: func(g *Goemon, j *job, command string, args []string) bool {
+			return g.processCommand(":start", nil, args)
+		}},
+		":wait-ready": {check: waitReadyArgs, run: (*Goemon).waitReadyInternalCommand},
+		":event":      {check: anyArgs, run: (*Goemon).eventCommand},
+		":foreach":    {check: foreachArgs, run: (*Goemon).foreachCommand},
+	}
+}
+
+// checkCommand validate the name and the arguments of the internal command
+func checkCommand(command string) error {
+	ss := strings.Fields(command)
+	b, ok := builtins[ss[0]]
+	if !ok {
+		return fmt.Errorf("unknown internal command %s", ss[0])
+	}
+	return b.check(command, ss[1:])
+}
+
+func (g *Goemon) internalCommand(command string, j *job) bool {
+	if err := checkCommand(command); err != nil {
+		g.Logger.Println(err)
+		return false
+	}
 	ss := strings.Fields(command)
-	switch ss[0] {
-	case ":livereload":
-		for _, s := range ss[1:] {
-			g.Logger.Println("reloading", s)
-			g.lrs.Reload(s, true)
+	return builtins[ss[0]].run(g, j, command, ss[1:])
+}
+
+func anyArgs(command string, args []string) error {
+	return nil
+}
+
+// intArgs check the arguments are milliseconds or counts
+func intArgs(command string, args []string) error {
+	for _, s := range args {
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			return fmt.Errorf("invalid argument for %s command: %q", strings.Fields(command)[0], s)
 		}
-		return true
-	case ":sleep":
-		for _, s := range ss[1:] {
-			si, err := strconv.ParseInt(s, 10, 64)
-			if err != nil {
-				g.Logger.Println("failed to parse argument for :sleep command:", err)
-				return false
-			}
-			g.Logger.Println("sleeping", s+"ms")
-			time.Sleep(time.Duration(si) * time.Millisecond)
+	}
+	return nil
+}
+
+func fileArg(command string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%s command needs a file", strings.Fields(command)[0])
+	}
+	return nil
+}
+
+func waitReadyArgs(command string, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("too many arguments for %s command", strings.Fields(command)[0])
+	}
+	return intArgs(command, args)
+}
+
+func goBuildArgs(command string, args []string) error {
+	_, _, err := parseGoBuildArgs(args)
+	return err
+}
+
+// foreachSubCommand return the sub-command of :foreach
+func foreachSubCommand(command string) string {
+	command = strings.TrimSpace(command)
+	return strings.TrimSpace(strings.TrimPrefix(command, strings.Fields(command)[0]))
+}
+
+func foreachArgs(command string, args []string) error {
+	sub := foreachSubCommand(command)
+	if sub == "" {
+		return fmt.Errorf("missing argument for %s command", strings.Fields(command)[0])
+	}
+	if commandRe.MatchString(sub) {
+		return checkCommand(sub)
+	}
+	return nil
+}
+
+func (g *Goemon) liveReloadCommand(j *job, command string, args []string) bool {
+	if j.restart {
+		// the app should be ready before the page is reloaded
+		j.restart = false
+		if !g.waitReadyCommand(g.conf.Ready.timeout()) {
+			return false
 		}
-		return true
-	case ":fizzbuzz":
-		for _, s := range ss[1:] {
-			si, err := strconv.ParseInt(s, 10, 64)
-			if err != nil {
-				g.Logger.Println("failed to parse argument for :fizzbuzz command:", err)
-				return false
-			}
-			for i := int64(1); i <= si; i++ {
-				switch {
-				case i%15 == 0:
-					g.Logger.Println("FizzBuzz")
-				case i%3 == 0:
-					g.Logger.Println("Fizz")
-				case i%5 == 0:
-					g.Logger.Println("Buzz")
-				default:
-					g.Logger.Println(i)
-				}
+	}
+	if css := g.stylesheets(j); len(css) > 0 {
+		// only stylesheets changed, swap them without full reload
+		args = css
+	}
+	for _, s := range args {
+		g.Logger.Println("reloading", s)
+		g.lrs.Reload(s, true)
+	}
+	return true
+}
+
+func (g *Goemon) liveReloadCSSCommand(j *job, command string, args []string) bool {
+	for _, s := range g.stylesheets(j) {
+		g.Logger.Println("reloading", s)
+		g.lrs.Reload(s, true)
+	}
+	return true
+}
+
+func (g *Goemon) sleepCommand(j *job, command string, args []string) bool {
+	for _, s := range args {
+		si, _ := strconv.ParseInt(s, 10, 64)
+		g.Logger.Println("sleeping", s+"ms")
+		time.Sleep(time.Duration(si) * time.Millisecond)
+	}
+	return true
+}
+
+func (g *Goemon) fizzBuzzCommand(j *job, command string, args []string) bool {
+	for _, s := range args {
+		si, _ := strconv.ParseInt(s, 10, 64)
+		for i := int64(1); i <= si; i++ {
+			switch {
+			case i%15 == 0:
+				g.Logger.Println("FizzBuzz")
+			case i%3 == 0:
+				g.Logger.Println("Fizz")
+			case i%5 == 0:
+				g.Logger.Println("Buzz")
+			default:
+				g.Logger.Println(i)
 			}
 		}
+	}
+	return true
+}
+
+func (g *Goemon) minifyCommand(j *job, command string, args []string) bool {
+	for _, f := range j.files {
+		if !g.minify(f) {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *Goemon) waitReadyInternalCommand(j *job, command string, args []string) bool {
+	timeout := g.conf.Ready.timeout()
+	if len(args) > 0 {
+		si, _ := strconv.ParseInt(args[0], 10, 64)
+		timeout = time.Duration(si) * time.Millisecond
+	}
+	j.restart = false
+	return g.waitReadyCommand(timeout)
+}
+
+func (g *Goemon) eventCommand(j *job, command string, args []string) bool {
+	for _, s := range args {
+		g.Logger.Println("fire", s)
+		g.task(fswatcher.Event{Name: s, Op: fswatcher.Write})
+	}
+	return true
+}
+
+func (g *Goemon) foreachCommand(j *job, command string, args []string) bool {
+	sub := foreachSubCommand(command)
+	for _, f := range j.files {
+		if j.isCanceled() {
+			return false
+		}
+		// the sub-command is canceled with the job
+		fj := &job{file: f, files: []string{f}, group: j.group, parent: j}
+		var ok bool
+		if commandRe.MatchString(sub) {
+			ok = g.internalCommand(sub, fj)
+		} else {
+			ok = g.externalCommand(sub, fj)
+		}
+		if !ok {
+			// report the output of the failed sub-command
+			j.output, j.diagnostics = fj.output, fj.diagnostics
+			return false
+		}
+	}
+	return true
+}
+
+// stylesheets return the asset paths of the changed files when all of them
+// are stylesheets.
+func (g *Goemon) stylesheets(j *job) []string {
+	var paths []string
+	for _, f := range j.files {
+		if strings.ToLower(filepath.Ext(f)) != ".css" {
+			return nil
+		}
+		paths = append(paths, assetPath(f))
+	}
+	return paths
+}
+
+// assetPath return the path of file relative to current directory as URL
+// path.
+func assetPath(file string) string {
+	if cwd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(cwd, filepath.FromSlash(file)); err == nil && !strings.HasPrefix(rel, "..") {
+			file = rel
+		}
+	}
+	return "/" + strings.TrimPrefix(filepath.ToSlash(file), "/")
+}
+
+func (g *Goemon) restartCommand(sig os.Signal, j *job, names []string) bool {
+	if g.failed(j.task) {
+		g.Logger.Println("build failed, keeping previous version")
 		return true
-	case ":minify":
-		return g.minify(file)
-	case ":restart!":
-		return g.terminate(os.Kill) == nil
-	case ":restart":
-		return g.terminate(os.Interrupt) == nil
-	case ":event":
-		for _, s := range ss[1:] {
-			g.Logger.Println("fire", s)
-			g.task(fswatcher.Event{Name: s, Op: fswatcher.Write})
+	}
+	if len(names) > 0 {
+		return g.processCommand(":restart", sig, names)
+	}
+	if len(g.Args) == 0 {
+		return g.terminate(sig) == nil
+	}
+	atomic.StoreUint32(&g.restarting, 1)
+	j.restart = true
+	if sig != os.Kill && g.canHandoff() {
+		if err := g.handoff(sig); err != nil {
+			g.Logger.Println(err)
+			atomic.StoreUint32(&g.restarting, 0)
+			return false
 		}
 		return true
 	}
-	return false
+	g.readyChan(true)
+	return g.terminate(sig) == nil
+}
+
+// restartIfChangedCommand restart the command only when the file is
+// changed from the version which was spawned last time. Otherwise, the rest
+// of the commands are skipped.
+func (g *Goemon) restartIfChangedCommand(j *job, file string) bool {
+	h, err := hashFile(file)
+	if err != nil {
+		g.Logger.Println(err)
+		return false
+	}
+	g.mutex.Lock()
+	if g.artifacts == nil {
+		g.artifacts = map[string]string{}
+	}
+	prev, ok := g.artifacts[file]
+	if !ok {
+		// the hash is recorded when the command is spawned
+		g.artifacts[file] = ""
+	}
+	g.mutex.Unlock()
+	if ok && prev == h {
+		g.Logger.Println("not changed, skipping restart:", file)
+		j.skip = true
+		return true
+	}
+	g.Logger.Println("changed, restarting:", file)
+	return g.restartCommand(nil, j, nil)
+}
+
+// hashArtifacts return the hashes of the files checked by
+// :restart-if-changed. It is called when the command is spawned.
+func (g *Goemon) hashArtifacts() map[string]string {
+	g.mutex.Lock()
+	var files []string
+	for file := range g.artifacts {
+		files = append(files, file)
+	}
+	g.mutex.Unlock()
+	hashes := map[string]string{}
+	for _, file := range files {
+		// the file is restarted on next check when it can not be read
+		hashes[file], _ = hashFile(file)
+	}
+	return hashes
+}
+
+// setArtifacts record the hashes of the files which the spawned command is
+// built from. It should be called with the lock.
+func (g *Goemon) setArtifacts(hashes map[string]string) {
+	for file, h := range hashes {
+		g.artifacts[file] = h
+	}
+}
+
+// hashFile return SHA-256 of the file
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (g *Goemon) waitReadyCommand(timeout time.Duration) bool {
+	if !g.conf.Ready.configured() {
+		return true
+	}
+	g.Logger.Println("waiting for ready")
+	if err := g.waitReady(timeout); err != nil {
+		g.Logger.Println(err)
+		return false
+	}
+	g.Logger.Println("ready")
+	return true
+}
+
+func quote(s string) string {
+	if runtime.GOOS == "windows" {
+		return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+	}
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
+
+// writeList write NUL separated list of files into temporary file
+func writeList(files []string) (string, error) {
+	f, err := ioutil.TempFile("", "goemon")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for _, file := range files {
+		if _, err = f.WriteString(file + "\x00"); err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+	return f.Name(), nil
 }
 
-func (g *Goemon) externalCommand(command, file string) bool {
+func (g *Goemon) externalCommand(command string, j *job) bool {
 	var cmd *exec.Cmd
+	file := j.file
+	list, err := writeList(j.files)
+	if err != nil {
+		g.Logger.Println(err)
+		return false
+	}
+	defer os.Remove(list)
 	command = os.Expand(command, func(s string) string {
 		switch s {
 		case "GOEMON_TARGET_FILE":
@@ -92,26 +420,74 @@ func (g *Goemon) externalCommand(command, file string) bool {
 			fn := filepath.Base(file)
 			ext := filepath.Ext(file)
 			return fn[:len(fn)-len(ext)]
+		case "GOEMON_TARGET_FILES":
+			qs := make([]string, len(j.files))
+			for i, f := range j.files {
+				qs[i] = quote(f)
+			}
+			return strings.Join(qs, " ")
+		case "GOEMON_TARGET_LIST":
+			return list
 		}
 		return os.Getenv(s)
 	})
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("cmd", "/c", command)
-	} else {
-		cmd = exec.Command("sh", "-c", command)
-	}
+	args := shell(command)
+	cmd = exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "GOEMON_TARGET_LIST="+list)
 	g.Logger.Println("executing", command)
 	cmd.Stdin = os.Stdin
+	var stderr bytes.Buffer
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	err = g.runCommand(cmd, j)
 	if err != nil {
 		g.Logger.Println(err)
+		j.output = tail(stderr.String(), maxOutput)
 		return false
 	}
 	return true
 }
 
+// runCommand run cmd as the command of the job, so that it can be canceled
+func (g *Goemon) runCommand(cmd *exec.Cmd, j *job) error {
+	if j.group {
+		setpgid(cmd)
+	}
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	j = j.root()
+	j.mutex.Lock()
+	j.cmd = cmd
+	canceled := j.canceled
+	j.mutex.Unlock()
+	if canceled {
+		g.stop(cmd, os.Kill, 0)
+	}
+	err = cmd.Wait()
+	j.mutex.Lock()
+	j.cmd = nil
+	j.mutex.Unlock()
+	return err
+}
+
+// maxOutput is the maximum size of the output kept for the error overlay
+const maxOutput = 64 * 1024
+
+// tail return the last n bytes of s at most. The cut point is moved forward
+// to the start of a rune not to split it.
+func tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	i := len(s) - n
+	for i < len(s) && !utf8.RuneStart(s[i]) {
+		i++
+	}
+	return s[i:]
+}
+
 func (g *Goemon) minify(name string) bool {
 	ext := filepath.Ext(name)
 	if ext == "" {
@@ -163,9 +539,32 @@ func (g *Goemon) minify(name string) bool {
 	return false
 }
 
-func (g *Goemon) livereload() error {
-	g.lrs = livereload.New("goemon")
-	defer g.lrs.Close()
+// overlayPrefix is the prefix of the alert message which the livereload
+// script shows as the error overlay.
+const overlayPrefix = "goemon:"
+
+// overlay is the message for the error overlay in the browser
+type overlay struct {
+	Type   string `json:"type"`
+	Title  string `json:"title,omitempty"`
+	Output string `json:"output,omitempty"`
+	// Diagnostics is the errors reported by :gobuild
+	Diagnostics []diagnostic `json:"diagnostics,omitempty"`
+}
+
+func (g *Goemon) overlay(o *overlay) {
+	if g.lrs == nil {
+		return
+	}
+	b, err := json.Marshal(o)
+	if err != nil {
+		g.Logger.Println(err)
+		return
+	}
+	g.lrs.Alert(overlayPrefix + string(b))
+}
+
+func (g *Goemon) liveReloadAddr() string {
 	addr := g.conf.LiveReload
 	if addr == "" {
 		addr = os.Getenv("GOEMON_LIVERELOAD_ADDR")
@@ -173,8 +572,14 @@ func (g *Goemon) livereload() error {
 	if addr == "" {
 		addr = ":35730"
 	}
+	return addr
+}
+
+func (g *Goemon) livereload() error {
+	g.lrs = livereload.New("goemon")
+	defer g.lrs.Close()
 	var err error
-	g.lrc, err = net.Listen("tcp", addr)
+	g.lrc, err = net.Listen("tcp", g.liveReloadAddr())
 	if err != nil {
 		return err
 	}
@@ -187,6 +592,13 @@ func (g *Goemon) livereload() error {
 			g.Logger.Println(err)
 		}
 	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(g.status())
+		if err != nil {
+			g.Logger.Println(err)
+		}
+	})
 	mux.Handle("/livereload", g.lrs)
 	return http.Serve(g.lrc, mux)
 }
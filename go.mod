@@ -8,7 +8,7 @@ require (
 	github.com/omeid/livereload v0.0.0-20180903043807-18d58b752b26
 	github.com/rakyll/statik v0.1.8
 	github.com/tdewolff/minify v2.3.6+incompatible
-	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
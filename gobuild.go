@@ -0,0 +1,168 @@
+package goemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// diagnostic is the error reported by the Go toolchain
+type diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Col     int    `json:"col,omitempty"`
+	Message string `json:"message"`
+}
+
+func (d diagnostic) String() string {
+	if d.Col > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Col, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+}
+
+// colored return the diagnostic for the terminal
+func (d diagnostic) colored() string {
+	pos := fmt.Sprintf("%s:%d", d.File, d.Line)
+	if d.Col > 0 {
+		pos += ":" + strconv.Itoa(d.Col)
+	}
+	return color(pos+":", "1") + " " + color(d.Message, "31")
+}
+
+// color return s decorated with the ANSI escape sequence
+func color(s, code string) string {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return s
+	}
+	return "\x1b[" + code + "m" + s + "\x1b[0m"
+}
+
+var diagnosticRe = regexp.MustCompile(`^(.+?\.go):(\d+)(?::(\d+))?: (.*)$`)
+
+// buildEvent is the line of `go build -json`
+type buildEvent struct {
+	ImportPath string
+	Action     string
+	Output     string
+}
+
+// parseBuildOutput parse the output of `go build -json`. Lines which are
+// not JSON are treated as plain text output of the toolchain.
+func parseBuildOutput(r io.Reader) ([]diagnostic, string) {
+	var diags []diagnostic
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		text := scanner.Text() + "\n"
+		if strings.HasPrefix(text, "{") {
+			var ev buildEvent
+			if err := json.Unmarshal(scanner.Bytes(), &ev); err == nil {
+				if ev.Action != "build-output" {
+					continue
+				}
+				text = ev.Output
+			}
+		}
+		out.WriteString(text)
+		for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+			if m := diagnosticRe.FindStringSubmatch(line); m != nil {
+				d := diagnostic{File: m[1], Message: m[4]}
+				d.Line, _ = strconv.Atoi(m[2])
+				d.Col, _ = strconv.Atoi(m[3])
+				diags = append(diags, d)
+			} else if strings.HasPrefix(line, "\t") && len(diags) > 0 {
+				// continuation of the previous message
+				diags[len(diags)-1].Message += "\n" + line
+			}
+		}
+	}
+	return diags, out.String()
+}
+
+// parseGoBuildArgs parse the arguments of :gobuild [pkg...] [-o out]
+func parseGoBuildArgs(args []string) ([]string, string, error) {
+	var pkgs []string
+	var out string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-o":
+			if i+1 >= len(args) {
+				return nil, "", fmt.Errorf("missing argument for -o of :gobuild command")
+			}
+			out = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], "-"):
+			return nil, "", fmt.Errorf("unknown flag for :gobuild command: %s", args[i])
+		default:
+			pkgs = append(pkgs, args[i])
+		}
+	}
+	if len(pkgs) == 0 {
+		pkgs = []string{"."}
+	}
+	return pkgs, out, nil
+}
+
+// goBuildCommand run `go build` for :gobuild [pkg...] [-o out]
+func (g *Goemon) goBuildCommand(j *job, args []string) bool {
+	pkgs, out, err := parseGoBuildArgs(args)
+	if err != nil {
+		g.Logger.Println(err)
+		return false
+	}
+	cmdArgs := []string{"build"}
+	if out != "" {
+		cmdArgs = append(cmdArgs, "-o", out)
+	}
+	cmdArgs = append(cmdArgs, pkgs...)
+
+	g.Logger.Println("building", strings.Join(pkgs, " "))
+	var buf bytes.Buffer
+	build := func(args []string) error {
+		buf.Reset()
+		cmd := exec.Command("go", args...)
+		cmd.Stdout = &buf
+		cmd.Stderr = &buf
+		return g.runCommand(cmd, j)
+	}
+	if atomic.LoadUint32(&g.plainBuild) == 0 {
+		err = build(append([]string{"build", "-json"}, cmdArgs[1:]...))
+		if err != nil && strings.Contains(buf.String(), "flag provided but not defined: -json") {
+			// go build -json is available since Go 1.24
+			g.Logger.Println("go build does not support -json, parsing plain output")
+			atomic.StoreUint32(&g.plainBuild, 1)
+		}
+	}
+	if atomic.LoadUint32(&g.plainBuild) == 1 {
+		err = build(cmdArgs)
+	}
+	diags, output := parseBuildOutput(&buf)
+	j.diagnostics = diags
+	if err == nil {
+		os.Stderr.WriteString(output)
+		return true
+	}
+	g.Logger.Println(err)
+	if len(diags) == 0 {
+		os.Stderr.WriteString(output)
+		j.output = tail(output, maxOutput)
+		return false
+	}
+	var plain bytes.Buffer
+	for _, d := range diags {
+		fmt.Fprintln(os.Stderr, d.colored())
+		fmt.Fprintln(&plain, d)
+	}
+	j.output = tail(plain.String(), maxOutput)
+	return false
+}
@@ -1,8 +1,6 @@
 package goemon
 
 import (
-	"bytes"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
@@ -12,6 +10,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -19,43 +18,126 @@ import (
 
 	"github.com/fswatcher/fswatcher"
 	"github.com/omeid/livereload"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 const logFlag = log.Ldate | log.Ltime | log.Lshortfile
 
-var commandRe = regexp.MustCompile(`^\s*(:[a-z]+!?)(?:\s+(\S+))*$`)
+var commandRe = regexp.MustCompile(`^\s*(:[a-z][a-z-]*!?)(?:\s+(\S+))*$`)
 
 // Goemon is structure of this application
 type Goemon struct {
-	tasks uint64
+	tasks   uint64
+	changes uint64
 
 	File   string
 	Logger *log.Logger
 	Args   []string
-	lrc    net.Listener
-	lrs    *livereload.Server
-	fsw    *fswatcher.Watcher
-	cmd    *exec.Cmd
-	conf   conf
+	// Watcher is the backend to watch files. "poll" polls the files.
+	Watcher string
+	lrc     net.Listener
+	lrs     *livereload.Server
+	fsw     watcher
+	cmd     *exec.Cmd
+	procs   map[string]*process
+	conf    conf
+
+	mutex      sync.Mutex
+	failures   map[*task]*failure
+	ready      chan struct{}
+	restarting uint32
+	state      string
+	sock       *os.File
+	next       *handoff
+	artifacts  map[string]string
+	watched    map[string]bool
+	modules    []string
+	modFiles   map[string]bool
+	ign        *ignorer
+	hashes     hashCache
+	plainBuild uint32
 }
 
 type task struct {
-	Match    string   `yaml:"match"`
-	Ignore   string   `yaml:"ignore"`
+	Match    patterns `yaml:"match"`
+	Ignore   patterns `yaml:"ignore"`
+	Dir      string   `yaml:"dir"`
 	Commands []string `yaml:"commands"`
 	Ops      []string `yaml:"ops"`
-	mre      *regexp.Regexp
-	ire      *regexp.Regexp
+	Debounce *int     `yaml:"debounce"`
+	OnBusy   string   `yaml:"on_busy"`
+	GoMod    bool     `yaml:"gomod"`
+	mre      *wildcard
+	ire      *wildcard
+	gmre     []*wildcard
+	gire     []*wildcard
 	mops     uint32
 	hit      bool
+	job      *job
+	files    []string
+	timer    *time.Timer
 	mutex    sync.Mutex
+
+	SkipUnchanged bool `yaml:"skip_unchanged"`
 }
 
 type conf struct {
 	Command    string
-	LiveReload string  `yaml:"livereload"`
-	Tasks      []*task `yaml:"tasks"`
+	LiveReload string   `yaml:"livereload"`
+	Debounce   int      `yaml:"debounce"`
+	Proxy      proxy    `yaml:"proxy"`
+	Ready      probe    `yaml:"ready"`
+	Socket     string   `yaml:"socket"`
+	Ignore     []string `yaml:"ignore"`
+	Tasks      []*task  `yaml:"tasks"`
+
+	Watcher      string `yaml:"watcher"`
+	PollInterval int    `yaml:"poll_interval"`
+
+	Processes map[string]*process `yaml:"processes"`
+
+	restartPolicy `yaml:",inline"`
+	stopPolicy    `yaml:",inline"`
+}
+
+// failure is the last failed run of a task
+type failure struct {
+	Task    string    `json:"task"`
+	Command string    `json:"command"`
+	Files   []string  `json:"files"`
+	Output  string    `json:"output"`
+	Time    time.Time `json:"time"`
+	// Diagnostics is the errors reported by :gobuild
+	Diagnostics []diagnostic `json:"diagnostics,omitempty"`
+}
+
+// status is the state of goemon served by the status API
+type status struct {
+	State     string           `json:"state"`
+	Command   string           `json:"command,omitempty"`
+	Tasks     uint64           `json:"tasks"`
+	Failures  []*failure       `json:"failures"`
+	Processes []*processStatus `json:"processes"`
+}
+
+// job is a run of the commands of a task for a batch of changed files
+type job struct {
+	task     *task
+	file     string
+	files    []string
+	group    bool
+	output   string
+	restart  bool
+	skip     bool
+	cmd      *exec.Cmd
+	canceled bool
+	mutex    sync.Mutex
+
+	// parent is the job which runs this job by :foreach
+	parent *job
+
+	// diagnostics is the errors reported by :gobuild
+	diagnostics []diagnostic
 }
 
 // New create new instance of goemon
@@ -78,68 +160,85 @@ func Run() *Goemon {
 	return New().Run()
 }
 
-func compilePattern(pattern string) (*regexp.Regexp, error) {
-	if pattern[0] == '%' {
-		return regexp.Compile(pattern[1:])
+// shell return arguments to run command with shell
+func shell(command string) []string {
+	if runtime.GOOS == "windows" {
+		return []string{"cmd", "/c", command}
 	}
-
-	var buf bytes.Buffer
-
-	for n, pat := range strings.Split(pattern, "|") {
-		if n == 0 {
-			buf.WriteString("^")
-		} else {
-			buf.WriteString("$|")
-		}
-		if fs, err := filepath.Abs(pat); err == nil {
-			pat = filepath.ToSlash(fs)
-		}
-		rs := []rune(pat)
-		for i := 0; i < len(rs); i++ {
-			if rs[i] == '/' {
-				if runtime.GOOS == "windows" {
-					buf.WriteString(`[/\\]`)
-				} else {
-					buf.WriteRune(rs[i])
-				}
-			} else if rs[i] == '*' {
-				if i < len(rs)-1 && rs[i+1] == '*' {
-					i++
-					if i < len(rs)-1 && rs[i+1] == '/' {
-						i++
-						buf.WriteString(`.*`)
-					} else {
-						return nil, fmt.Errorf("invalid wildcard: %s", pattern)
-					}
-				} else {
-					buf.WriteString(`[^/]+`)
-				}
-			} else if rs[i] == '?' {
-				if runtime.GOOS == "windows" {
-					buf.WriteString(`[^/\\]`)
-				} else {
-					buf.WriteString(`[^/]`)
-				}
-			} else {
-				buf.WriteString(fmt.Sprintf(`[\x{%x}]`, rs[i]))
-			}
-		}
-		buf.WriteString("$")
-	}
-
-	return regexp.Compile(buf.String())
+	return []string{"sh", "-c", command}
 }
 
 func (g *Goemon) restart() error {
 	if len(g.Args) == 0 {
 		return nil
 	}
+	g.mutex.Lock()
+	next := g.next
+	g.next = nil
+	if next != nil {
+		// the command is already started by handoff
+		g.cmd = next.cmd
+	}
+	g.mutex.Unlock()
+	if next != nil {
+		err := <-next.done
+		g.exit(next.cmd)
+		return err
+	}
 	g.terminate(nil)
 	return g.spawn()
 }
 
+func (g *Goemon) spawn() error {
+	cmd, err := g.command()
+	if err != nil {
+		return err
+	}
+	hashes := g.hashArtifacts()
+	// the command is published after started, terminate may read it while
+	// it is running
+	g.mutex.Lock()
+	err = cmd.Start()
+	if err == nil {
+		g.cmd = cmd
+		g.setArtifacts(hashes)
+	}
+	g.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	err = cmd.Wait()
+	g.exit(cmd)
+	return err
+}
+
+// running return the command spawned last while it is running
+func (g *Goemon) running() *exec.Cmd {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.cmd
+}
+
+// exit forget cmd which exited, not to stop it again
+func (g *Goemon) exit(cmd *exec.Cmd) {
+	g.mutex.Lock()
+	if g.cmd == cmd {
+		g.cmd = nil
+	}
+	g.mutex.Unlock()
+}
+
 func (t *task) match(file string) bool {
-	return (t.mre != nil && t.mre.MatchString(file)) && (t.ire == nil || !t.ire.MatchString(file))
+	if (t.mre != nil && t.mre.MatchString(file)) && (t.ire == nil || !t.ire.MatchString(file)) {
+		return true
+	}
+	// the patterns for the local modules of gomod
+	for i, re := range t.gmre {
+		if re.MatchString(file) && (t.gire[i] == nil || !t.gire[i].MatchString(file)) {
+			return true
+		}
+	}
+	return false
 }
 
 func (t *task) matchOp(op fswatcher.Op) bool {
@@ -149,11 +248,28 @@ func (t *task) matchOp(op fswatcher.Op) bool {
 	return uint32(op)&t.mops == uint32(op)
 }
 
+func (t *task) add(file string) {
+	for _, f := range t.files {
+		if f == file {
+			return
+		}
+	}
+	t.files = append(t.files, file)
+}
+
+func (g *Goemon) debounce(t *task) time.Duration {
+	if t.Debounce != nil {
+		return time.Duration(*t.Debounce) * time.Millisecond
+	}
+	return time.Duration(g.conf.Debounce) * time.Millisecond
+}
+
 func (g *Goemon) task(event fswatcher.Event) {
 	file := filepath.ToSlash(event.Name)
+	checked, unchanged := false, false
 	for _, t := range g.conf.Tasks {
 		if strings.HasPrefix(event.Name, ":") {
-			if t.Match != file {
+			if t.Match.String() != file {
 				continue
 			}
 		} else {
@@ -164,41 +280,288 @@ func (g *Goemon) task(event fswatcher.Event) {
 		if !t.matchOp(event.Op) {
 			continue
 		}
+		if t.SkipUnchanged && !strings.HasPrefix(event.Name, ":") {
+			// the hash is computed once for the event
+			if !checked {
+				unchanged = g.hashes.unchanged(event)
+				checked = true
+			}
+			if unchanged {
+				g.Logger.Println("unchanged", event)
+				continue
+			}
+		}
 		t.mutex.Lock()
 		if t.hit {
+			switch t.OnBusy {
+			case "queue":
+				g.Logger.Println("queued", event)
+				t.add(file)
+			case "restart":
+				g.Logger.Println("restarting task", event)
+				t.add(file)
+				go g.cancel(t.job)
+			}
 			t.mutex.Unlock()
 			continue
 		}
-		t.hit = true
-		t.mutex.Unlock()
 		g.Logger.Println(event)
-		go func(name string, t *task) {
-			atomic.AddUint64(&g.tasks, 1)
-
-		loopCommand:
-			for _, command := range t.Commands {
-				switch {
-				case commandRe.MatchString(command):
-					if !g.internalCommand(command, file) {
-						break loopCommand
-					}
-				default:
-					if !g.externalCommand(command, file) {
-						break loopCommand
-					}
+		t.add(file)
+		now := g.schedule(t)
+		t.mutex.Unlock()
+		if now {
+			g.fire(t)
+		}
+	}
+}
+
+// schedule start or extend the debounce timer of the task. It returns true
+// when the task should be fired immediately.
+func (g *Goemon) schedule(t *task) bool {
+	d := g.debounce(t)
+	if d <= 0 {
+		return true
+	}
+	// gather events until the task is quiet for the period
+	if t.timer == nil {
+		t.timer = time.AfterFunc(d, func() { g.fire(t) })
+	} else {
+		t.timer.Reset(d)
+	}
+	return false
+}
+
+func (g *Goemon) fire(t *task) {
+	t.mutex.Lock()
+	if t.hit || len(t.files) == 0 {
+		t.mutex.Unlock()
+		return
+	}
+	files := t.files
+	t.files = nil
+	t.timer = nil
+	t.hit = true
+	t.job = &job{task: t, file: files[len(files)-1], files: files, group: t.OnBusy == "restart"}
+	j := t.job
+	t.mutex.Unlock()
+
+	atomic.AddUint64(&g.tasks, 1)
+	atomic.AddUint64(&g.changes, 1)
+	go g.run(t, j)
+}
+
+func (g *Goemon) run(t *task, j *job) {
+	failed := ""
+loopCommand:
+	for _, command := range t.Commands {
+		if j.isCanceled() {
+			break
+		}
+		switch {
+		case commandRe.MatchString(command):
+			if !g.internalCommand(command, j) {
+				failed = command
+				break loopCommand
+			}
+			if j.skip {
+				// the rest of the commands are not needed
+				break loopCommand
+			}
+		default:
+			if !g.externalCommand(command, j) {
+				failed = command
+				break loopCommand
+			}
+		}
+	}
+	if !j.isCanceled() {
+		g.report(t, j, failed)
+	}
+	t.mutex.Lock()
+	t.hit = false
+	t.job = nil
+	if j.isCanceled() {
+		// start over with the merged change set
+		files := t.files
+		t.files = j.files
+		for _, f := range files {
+			t.add(f)
+		}
+	}
+	now := len(t.files) > 0 && g.schedule(t)
+	t.mutex.Unlock()
+	if now {
+		g.fire(t)
+	}
+	atomic.AddUint64(&g.tasks, ^uint64(0))
+}
+
+// report record the outcome of the job. command is the failed command, or
+// empty when all of the commands succeeded.
+func (g *Goemon) report(t *task, j *job, command string) {
+	g.mutex.Lock()
+	if command == "" {
+		_, ok := g.failures[t]
+		delete(g.failures, t)
+		cleared := ok && len(g.failures) == 0
+		g.mutex.Unlock()
+		if ok {
+			g.Logger.Println("task succeeded", t.Match.String())
+		}
+		if cleared {
+			g.overlay(&overlay{Type: "clear"})
+		}
+		return
+	}
+	if g.failures == nil {
+		g.failures = map[*task]*failure{}
+	}
+	f := &failure{
+		Task:    t.Match.String(),
+		Command: command,
+		Files:   j.files,
+		Output:  j.output,
+		Time:    time.Now(),
+
+		Diagnostics: j.diagnostics,
+	}
+	g.failures[t] = f
+	g.mutex.Unlock()
+	if len(g.Args) > 0 {
+		g.Logger.Println("build failed, keeping previous version:", command)
+	} else {
+		g.Logger.Println("task failed:", command)
+	}
+	g.overlay(&overlay{Type: "error", Title: "failed: " + command, Output: f.Output, Diagnostics: f.Diagnostics})
+}
+
+// failed return true when the last run of any task except t in the chain of
+// t failed. When t is nil, the chains of all tasks restarting the command are
+// checked.
+func (g *Goemon) failed(t *task) bool {
+	chain := map[*task]bool{}
+	if t != nil {
+		g.chain(t, chain)
+	} else {
+		for _, rt := range g.conf.Tasks {
+			if rt.restarts() {
+				g.chain(rt, chain)
+			}
+		}
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for ft := range g.failures {
+		if ft != t && chain[ft] {
+			return true
+		}
+	}
+	return false
+}
+
+// chain add t and the tasks firing t with :event to tasks
+func (g *Goemon) chain(t *task, tasks map[*task]bool) {
+	if tasks[t] {
+		return
+	}
+	tasks[t] = true
+	name := t.Match.String()
+	for _, ft := range g.conf.Tasks {
+		for _, command := range ft.Commands {
+			ss := strings.Fields(command)
+			if len(ss) == 0 || ss[0] != ":event" {
+				continue
+			}
+			for _, s := range ss[1:] {
+				if s == name {
+					g.chain(ft, tasks)
 				}
 			}
-			t.mutex.Lock()
-			t.hit = false
-			t.mutex.Unlock()
-			atomic.AddUint64(&g.tasks, ^uint64(0))
-		}(event.Name, t)
+		}
+	}
+}
+
+// restarts return true when the task restarts the command
+func (t *task) restarts() bool {
+	for _, command := range t.Commands {
+		ss := strings.Fields(command)
+		if len(ss) == 0 {
+			continue
+		}
+		switch ss[0] {
+		case ":restart", ":restart!":
+			if len(ss) == 1 {
+				return true
+			}
+		case ":restart-if-changed":
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Goemon) status() *status {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	st := &status{
+		State:    "ok",
+		Command:  g.state,
+		Tasks:    atomic.LoadUint64(&g.tasks),
+		Failures: []*failure{},
+	}
+	for _, f := range g.failures {
+		st.Failures = append(st.Failures, f)
+	}
+	sort.Slice(st.Failures, func(i, j int) bool {
+		return st.Failures[i].Time.Before(st.Failures[j].Time)
+	})
+	st.Processes = g.processStatuses()
+	if st.Tasks > 0 {
+		st.State = "running"
+	} else if len(st.Failures) > 0 {
+		st.State = "failed"
+	}
+	return st
+}
+
+// root return the job started by the task
+func (j *job) root() *job {
+	for j.parent != nil {
+		j = j.parent
+	}
+	return j
+}
+
+func (j *job) isCanceled() bool {
+	j = j.root()
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.canceled
+}
+
+// cancel stop the job and kill the process group of the running command
+func (g *Goemon) cancel(j *job) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	j.canceled = true
+	cmd := j.cmd
+	j.mutex.Unlock()
+	if cmd != nil && cmd.Process != nil {
+		if err := g.stop(cmd, os.Interrupt, 5*time.Second); err != nil {
+			g.Logger.Println(err)
+		}
 	}
 }
 
 func (g *Goemon) watch() error {
+	name := g.Watcher
+	if name == "" {
+		name = g.conf.Watcher
+	}
 	var err error
-	g.fsw, err = fswatcher.NewWatcher()
+	g.fsw, err = newWatcher(name, time.Duration(g.conf.PollInterval)*time.Millisecond)
 	if err != nil {
 		return err
 	}
@@ -210,52 +573,174 @@ func (g *Goemon) watch() error {
 		g.Logger.Println(err)
 	}
 
-	dup := map[string]bool{}
+	g.watched = map[string]bool{}
+	g.ign = newIgnorer(root, g.conf.Ignore)
 	g.fsw.Add(root, fswatcher.All)
-	dup[root] = true
+	g.watched[root] = true
+	g.walk(root)
+	for _, dir := range g.taskDirs(root) {
+		g.Logger.Println("watching directory", dir)
+		g.ign.addRoot(dir)
+		g.walk(dir)
+	}
+	g.watchModules(nil)
+
+	g.Logger.Println("goemon loaded", g.File)
+
+	for {
+		select {
+		case event := <-g.fsw.Events():
+			if event.Name == g.File {
+				return nil
+			}
+			for _, name := range ignoreFiles {
+				if filepath.Base(event.Name) == name {
+					g.ign.reset(filepath.Dir(event.Name))
+				}
+			}
+			info, err := os.Stat(event.Name)
+			if g.ign.ignored(event.Name, err == nil && info.IsDir()) {
+				continue
+			}
+			if event.Op&fswatcher.Create != 0 {
+				if err == nil && info.IsDir() {
+					g.Logger.Println("watching new directory", event.Name)
+					g.watchDir(event.Name)
+					continue
+				}
+			}
+			if event.Op&(fswatcher.Remove|fswatcher.Rename) != 0 && g.watched[event.Name] && err != nil {
+				g.unwatch(event.Name)
+			}
+			if g.modFiles[event.Name] {
+				g.Logger.Println("reloading modules", event.Name)
+				old := g.modules
+				g.loadModules()
+				g.watchModules(old)
+			}
+			g.task(event)
+		case err := <-g.fsw.Errors():
+			if err != nil {
+				g.Logger.Println("error:", err)
+			}
+		}
+	}
+}
 
-	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+// walk add the directories under root which are not ignored, so that the
+// files and the directories created later in them are noticed.
+func (g *Goemon) walk(root string) {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if info == nil {
 			return err
 		}
-		if info.IsDir() {
+		if !info.IsDir() {
 			return nil
 		}
-		dir := filepath.Dir(path)
-		if _, ok := dup[dir]; !ok {
-			for _, t := range g.conf.Tasks {
-				if t.match(path) {
-					g.fsw.Add(dir, fswatcher.All)
-					dup[dir] = true
-					break
-				}
-			}
+		if path != root && g.ign.ignored(path, true) {
+			return filepath.SkipDir
+		}
+		if !g.watched[path] {
+			g.fsw.Add(path, fswatcher.All)
+			g.watched[path] = true
 		}
 		return nil
 	})
 	if err != nil {
 		g.Logger.Println(err)
 	}
+}
 
-	g.Logger.Println("goemon loaded", g.File)
+// taskDirs return dir of the tasks outside of root, which are not walked from
+// root.
+func (g *Goemon) taskDirs(root string) []string {
+	var dirs []string
+	dup := map[string]bool{}
+	for _, t := range g.conf.Tasks {
+		if t.Dir == "" {
+			continue
+		}
+		dir, err := filepath.Abs(t.Dir)
+		if err != nil || dup[dir] || dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			continue
+		}
+		dup[dir] = true
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
 
-	for {
-		select {
-		case event := <-g.fsw.Events:
-			if event.Name == g.File {
-				return nil
+// watchDir add the new directory and all of the directories under it, and
+// fire the tasks for the files which were created before watching.
+func (g *Goemon) watchDir(root string) {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if info == nil {
+			return err
+		}
+		if path != root && g.ign.ignored(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
 			}
-			g.task(event)
-		case err := <-g.fsw.Errors:
-			if err != nil {
-				g.Logger.Println("error:", err)
+			return nil
+		}
+		if info.IsDir() {
+			if !g.watched[path] {
+				g.fsw.Add(path, fswatcher.All)
+				g.watched[path] = true
 			}
+			return nil
+		}
+		g.task(fswatcher.Event{Name: path, Op: fswatcher.Create})
+		return nil
+	})
+	if err != nil {
+		g.Logger.Println(err)
+	}
+}
+
+// unwatch stop watching the removed directory and the directories under it
+func (g *Goemon) unwatch(dir string) {
+	for path := range g.watched {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			g.fsw.Remove(path)
+			delete(g.watched, path)
 		}
 	}
 }
 
+// watchModules watch the local modules and the go.mod files, and stop
+// watching the modules in old which are not used anymore.
+func (g *Goemon) watchModules(old []string) {
+	for f := range g.modFiles {
+		if !g.watched[f] {
+			g.fsw.Add(f, fswatcher.All)
+			g.watched[f] = true
+		}
+	}
+	current := map[string]bool{}
+	for _, dir := range g.modules {
+		current[dir] = true
+	}
+	root, _ := filepath.Abs(".")
+	for _, dir := range old {
+		if current[dir] || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			// the directories under current directory are watched anyway
+			continue
+		}
+		g.unwatch(dir)
+	}
+	for _, dir := range g.modules {
+		g.Logger.Println("watching module", dir)
+		g.ign.addRoot(dir)
+		g.walk(dir)
+	}
+}
+
 func (g *Goemon) load() error {
 	g.conf.Tasks = []*task{}
+	g.mutex.Lock()
+	g.failures = nil
+	g.mutex.Unlock()
 	fn, err := filepath.Abs(g.File)
 	if err != nil {
 		return err
@@ -276,24 +761,31 @@ func (g *Goemon) load() error {
 	if err != nil {
 		return err
 	}
-	if len(g.Args) == 0 && g.conf.Command != "" {
-		if runtime.GOOS == "windows" {
-			g.Args = []string{"cmd", "/c", g.conf.Command}
-		} else {
-			g.Args = []string{"sh", "-c", g.conf.Command}
+	if err := g.conf.Ready.compile(); err != nil {
+		g.Logger.Println(err)
+	}
+	if g.conf.Socket != "" && !g.conf.Ready.configured() {
+		g.Logger.Println("socket without ready probe, the command is stopped before the new one starts")
+	}
+	for name, p := range g.conf.Processes {
+		if err := p.Ready.compile(); err != nil {
+			g.Logger.Println(name, err)
 		}
 	}
+	if len(g.Args) == 0 && g.conf.Command != "" {
+		g.Args = shell(g.conf.Command)
+	}
 	for _, t := range g.conf.Tasks {
-		if t.Match == "" {
+		if len(t.Match) == 0 {
 			continue
 		}
-		t.mre, err = compilePattern(t.Match)
+		t.mre, err = t.Match.compile(t.Dir)
 		if err != nil {
 			g.Logger.Println(err)
 			continue
 		}
-		if t.Ignore != "" {
-			t.ire, err = compilePattern(t.Ignore)
+		if len(t.Ignore) > 0 {
+			t.ire, err = t.Ignore.compile(t.Dir)
 			if err != nil {
 				g.Logger.Println(err)
 			}
@@ -316,7 +808,13 @@ func (g *Goemon) load() error {
 				g.Logger.Printf("unknow operation %v", op)
 			}
 		}
+		switch t.OnBusy {
+		case "", "drop", "queue", "restart":
+		default:
+			g.Logger.Printf("unknown on_busy policy %v", t.OnBusy)
+		}
 	}
+	g.loadModules()
 	return nil
 }
 
@@ -356,36 +854,128 @@ func (g *Goemon) Run() *Goemon {
 		}
 	}()
 
+	if g.conf.Proxy.Listen != "" {
+		go func() {
+			g.Logger.Println("starting proxy", g.conf.Proxy.Listen)
+			for {
+				err := g.proxy()
+				if err != nil {
+					g.Logger.Println(err)
+					time.Sleep(time.Second)
+				}
+				g.Logger.Println("restarting proxy")
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	exit := func() {
+		g.terminate(nil)
+		g.stopProcesses()
+		os.Exit(0)
+	}
+
+	if g.procs == nil && len(g.conf.Processes) > 0 {
+		g.startProcesses()
+	}
+
 	if len(g.Args) > 0 {
 		g.Logger.Println("starting command", g.Args)
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt)
 		errChan := make(chan error, 1)
+		waiting := false
+		retries := 0
 		for {
-			if atomic.LoadUint64(&g.tasks) > 0 {
-				time.Sleep(time.Second)
-				continue
+			// :restart in the running task respawns the command immediately
+			restarting := atomic.CompareAndSwapUint32(&g.restarting, 1, 0)
+			if (atomic.LoadUint64(&g.tasks) > 0 && !restarting) || g.failed(nil) {
+				if !waiting && g.failed(nil) {
+					g.Logger.Println("build failed, waiting for successful build to restart command")
+					waiting = true
+				}
+				select {
+				case <-time.After(time.Second):
+					continue
+				case <-sig:
+					exit()
+				}
 			}
+			waiting = false
+			started := time.Now()
+			g.setState("running")
 			go func() {
 				err := g.restart()
 				errChan <- err
 			}()
 			select {
 			case err := <-errChan:
+				if atomic.LoadUint32(&g.restarting) == 1 {
+					retries = 0
+					g.Logger.Println("restarting command")
+					continue
+				}
 				if err != nil {
 					g.Logger.Println(err)
-					time.Sleep(time.Second)
 				}
-				g.Logger.Println("restarting command")
+				if time.Since(started) > g.conf.backoffMax() {
+					retries = 0
+				}
+				retries++
+				if !g.conf.respawn(err) || g.conf.exhausted(retries) {
+					if err != nil {
+						g.Logger.Println("command crashed, waiting for file change")
+						g.setState("crashed")
+					} else {
+						g.Logger.Println("command exited, waiting for file change")
+						g.setState("exited")
+					}
+					g.waitChange(sig, exit)
+					retries = 0
+					continue
+				}
+				d := g.conf.delay(retries)
+				g.Logger.Printf("restarting command in %v", d)
+				g.setState("backoff")
+				select {
+				case <-time.After(d):
+				case <-sig:
+					exit()
+				}
 			case <-sig:
-				g.terminate(nil)
-				os.Exit(0)
+				exit()
 			}
 		}
 	}
+	if len(g.procs) > 0 {
+		go func() {
+			<-sig
+			exit()
+		}()
+	} else {
+		signal.Stop(sig)
+	}
 	return g
 }
 
+func (g *Goemon) setState(state string) {
+	g.mutex.Lock()
+	g.state = state
+	g.mutex.Unlock()
+}
+
+// waitChange wait until a task is fired by the change of files, or the
+// command is restarted.
+func (g *Goemon) waitChange(sig chan os.Signal, exit func()) {
+	n := atomic.LoadUint64(&g.changes)
+	for atomic.LoadUint64(&g.changes) == n && atomic.LoadUint32(&g.restarting) == 0 {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-sig:
+			exit()
+		}
+	}
+}
+
 // Terminate stop goemon server
 func (g *Goemon) Terminate() {
 	if g.lrc != nil {
@@ -394,8 +984,7 @@ func (g *Goemon) Terminate() {
 	if g.fsw != nil {
 		g.fsw.Close()
 	}
-	if g.cmd != nil && g.cmd.Process != nil {
-		g.terminate(nil)
-	}
+	g.terminate(nil)
+	g.stopProcesses()
 	g.Logger.Println("goemon terminated")
 }
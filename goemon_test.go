@@ -2,13 +2,23 @@ package goemon
 
 import (
 	"bytes"
+	"errors"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/fswatcher/fswatcher"
 )
@@ -61,6 +71,63 @@ func TestCompilePatternQuestion(t *testing.T) {
 	}
 }
 
+func TestCompilePatternGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{`/path/*.{js,ts}`, `/path/app.js`, true},
+		{`/path/*.{js,ts}`, `/path/app.ts`, true},
+		{`/path/*.{js,ts}`, `/path/app.css`, false},
+		{`/path/{src,lib/**}/*.go`, `/path/lib/a/b/main.go`, true},
+		{`/path/{src,lib/**}/*.go`, `/path/src/main.go`, true},
+		{`/path/{src,lib/**}/*.go`, `/path/cmd/main.go`, false},
+		{`/path/./x/{a,b/../c}/*.go`, `/path/x/a/main.go`, true},
+		{`/path/./x/{a,b/../c}/*.go`, `/path/x/c}/main.go`, false},
+		{`/path/*.{min.{js,css},map}`, `/path/app.min.css`, true},
+		{`/path/*.{min.{js,css},map}`, `/path/app.css`, false},
+		{`/path/[abc].go`, `/path/b.go`, true},
+		{`/path/[abc].go`, `/path/d.go`, false},
+		{`/path/[a-c]?.go`, `/path/bx.go`, true},
+		{`/path/[a-c]?.go`, `/path/dx.go`, false},
+		{`/path/[!a-c].go`, `/path/d.go`, true},
+		{`/path/[!a-c].go`, `/path/a.go`, false},
+		{`/path/[^a-c].go`, `/path/d.go`, true},
+		{`/path/x[!a]y`, `/path/x/y`, false},
+		{`/path/[]]`, `/path/]`, true},
+		{`/path/**`, `/path/a/b/c.txt`, true},
+		{`/path/**`, `/other/c.txt`, false},
+		{`/path/**/*.go`, `/path/main.go`, true},
+		{`/path/**/*.go`, `/path/a/b/main.go`, true},
+		{`/path/**/*.go`, `/path/amain.go/x`, false},
+		{`/path/**/*.go|!/path/**/*_test.go`, `/path/a/main.go`, true},
+		{`/path/**/*.go|!/path/**/*_test.go`, `/path/a/main_test.go`, false},
+		{`%^/path/[0-9]+\.txt$`, `/path/123.txt`, true},
+		{`%^/path/[0-9]+\.txt$`, `/path/abc.txt`, false},
+	}
+	for _, test := range tests {
+		if runtime.GOOS == "windows" && test.pattern[0] != '%' {
+			if p, err := filepath.Abs(test.path); err == nil {
+				test.path = p
+			}
+		}
+		re, err := compilePattern(test.pattern)
+		if err != nil {
+			t.Fatal(test.pattern, err)
+		}
+		if re.MatchString(test.path) != test.expected {
+			t.Fatalf("%v should match %v: %v", test.pattern, test.path, test.expected)
+		}
+	}
+
+	for _, pattern := range []string{`/path/[abc.go`, `/path/{a,b.go`, `!`, ``, `%(`, `!/path/**/*_test.go`} {
+		if _, err := compilePattern(pattern); err == nil {
+			t.Fatalf("%v should be invalid", pattern)
+		}
+	}
+}
+
 func TestJsmin(t *testing.T) {
 	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
 	if err != nil {
@@ -106,7 +173,7 @@ func TestInternalCommandArgs(t *testing.T) {
 	g := New()
 	g.Logger = log.New(&buf, "", 0)
 
-	if !g.internalCommand(":sleep 1 2", "") {
+	if !g.internalCommand(":sleep 1 2", &job{}) {
 		t.Fatal("Should be succeeded")
 	}
 	out := buf.String()
@@ -116,6 +183,17 @@ func TestInternalCommandArgs(t *testing.T) {
 	if !strings.Contains(out, "sleeping 2ms") {
 		t.Fatalf("Should sleep for second argument: %v", out)
 	}
+
+	// the arguments are validated as goemon -check does
+	for _, command := range []string{":sleep abc", ":gobuild -bogus", ":restart-if-changed", ":foreach", ":reload"} {
+		buf.Reset()
+		if g.internalCommand(command, &job{}) {
+			t.Fatalf("Should be failed: %s", command)
+		}
+		if err := checkCommand(command); err == nil || !strings.Contains(buf.String(), err.Error()) {
+			t.Fatalf("Should report same error as -check for %s: %v", command, buf.String())
+		}
+	}
 }
 
 func TestSpawn(t *testing.T) {
@@ -361,6 +439,71 @@ tasks:
 	}
 }
 
+func TestMatchList(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := ioutil.TempFile(dir, "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(tmp.Name(), []byte(`
+tasks:
+- match:
+  # scripts
+  - './assets/*.js'
+  # styles
+  - './assets/*.css'
+  ignore:
+  - './assets/*.min.*'
+  - './assets/vendor.*'
+  commands:
+- match:
+  - './**/*.go'
+  - '!./**/*_test.go'
+  dir: ./server
+  commands:
+- match: ':Foo'
+  commands:
+`), 0644)
+
+	g := New()
+	g.File = tmp.Name()
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+	if g.conf.Tasks[2].Match.String() != ":Foo" {
+		t.Fatalf("Should keep string form: %v", g.conf.Tasks[2].Match)
+	}
+
+	tests := []struct {
+		task   int
+		file   string
+		result bool
+	}{
+		{0, "assets/a.js", true},
+		{0, "assets/a.css", true},
+		{0, "assets/a.min.js", false},
+		{0, "assets/vendor.css", false},
+		{0, "assets/a.html", false},
+		{1, "server/main.go", true},
+		{1, "server/api/api.go", true},
+		{1, "server/api/api_test.go", false},
+		{1, "main.go", false},
+	}
+	for _, test := range tests {
+		file, _ := filepath.Abs(test.file)
+		if g.conf.Tasks[test.task].match(filepath.ToSlash(file)) != test.result {
+			t.Fatalf("%v should be %v for task %d", test.file, test.result, test.task)
+		}
+	}
+}
+
 func TestMatchOp(t *testing.T) {
 	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
 	if err != nil {
@@ -541,3 +684,1246 @@ tasks:
 		}
 	}
 }
+
+func TestDebounce(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := ioutil.TempFile(dir, "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(tmp.Name(), []byte(`
+debounce: 100
+tasks:
+- match: './assets/*.js'
+  commands:
+  - :sleep 1
+`), 0644)
+
+	var buf bytes.Buffer
+	g := New()
+	g.Logger = log.New(&buf, "", 0)
+	g.File = tmp.Name()
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+
+	for _, name := range []string{"assets/a.js", "assets/b.js", "assets/a.js"} {
+		file, _ := filepath.Abs(name)
+		g.task(fswatcher.Event{Name: file, Op: fswatcher.Write})
+	}
+
+	g.conf.Tasks[0].mutex.Lock()
+	files := len(g.conf.Tasks[0].files)
+	g.conf.Tasks[0].mutex.Unlock()
+	if files != 2 {
+		t.Fatalf("Should gather changed files: %v", files)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	for i := 0; i < 50 && atomic.LoadUint64(&g.tasks) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := strings.Count(buf.String(), "sleeping 1ms"); n != 1 {
+		t.Fatalf("Should run commands once: %v", n)
+	}
+}
+
+func TestForeach(t *testing.T) {
+	var buf bytes.Buffer
+	g := New()
+	g.Logger = log.New(&buf, "", 0)
+
+	if !g.internalCommand(":foreach :sleep 1", &job{files: []string{"a", "b"}}) {
+		t.Fatal("Should be succeeded")
+	}
+	if n := strings.Count(buf.String(), "sleeping 1ms"); n != 2 {
+		t.Fatalf("Should run sub-command for each file: %v", n)
+	}
+	if g.internalCommand(":foreach", &job{files: []string{"a"}}) {
+		t.Fatal("Should not be succeeded without sub-command")
+	}
+}
+
+func TestTargetFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	files := []string{"/tmp/foo bar.go", "/tmp/it's.go"}
+
+	var buf bytes.Buffer
+	g := New()
+	g.Logger = log.New(&buf, "", 0)
+	command := `printf '%s\n' ${GOEMON_TARGET_FILES} > ` + out + `; tr '\0' '\n' < "$GOEMON_TARGET_LIST" >> ` + out
+	if !g.externalCommand(command, &job{file: files[1], files: files}) {
+		t.Fatal("Should be succeeded", buf.String())
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join(append(files, files...), "\n") + "\n"
+	if string(b) != expected {
+		t.Fatalf("Should expand all of files: %q", string(b))
+	}
+}
+
+func TestReportFailure(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp, err := ioutil.TempFile(dir, "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(tmp.Name(), []byte(`
+tasks:
+- match: './assets/*.js'
+  commands:
+  - :sleep abc
+  - :restart
+`), 0644)
+
+	var buf bytes.Buffer
+	g := New()
+	g.Logger = log.New(&buf, "", 0)
+	g.File = tmp.Name()
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+
+	file, _ := filepath.Abs("assets/a.js")
+	g.task(fswatcher.Event{Name: file, Op: fswatcher.Write})
+	for i := 0; i < 50 && atomic.LoadUint64(&g.tasks) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	st := g.status()
+	if st.State != "failed" || len(st.Failures) != 1 {
+		t.Fatalf("Should be failed: %v", st)
+	}
+	if st.Failures[0].Command != ":sleep abc" {
+		t.Fatalf("Should report failed command: %v", st.Failures[0].Command)
+	}
+	if !g.internalCommand(":restart", &job{}) {
+		t.Fatal("Should be succeeded")
+	}
+	if !strings.Contains(buf.String(), "keeping previous version") {
+		t.Fatalf("Should keep previous version: %v", buf.String())
+	}
+
+	g.report(g.conf.Tasks[0], &job{}, "")
+	if st := g.status(); st.State != "ok" {
+		t.Fatalf("Should be ok: %v", st)
+	}
+}
+
+func TestFailedChain(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "goemon.yml")
+	ioutil.WriteFile(conf, []byte(`
+tasks:
+- match: './server/*.go'
+  commands:
+  - :sleep abc
+  - :event :Restart
+- match: ':Restart'
+  commands:
+  - :restart
+- match: './assets/*.js'
+  commands:
+  - :sleep abc
+- match: './app/*.go'
+  commands:
+  - :restart
+`), 0644)
+
+	g := New()
+	g.Logger = log.New(ioutil.Discard, "", 0)
+	g.File = conf
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+	server, restart, assets, app := g.conf.Tasks[0], g.conf.Tasks[1], g.conf.Tasks[2], g.conf.Tasks[3]
+
+	tests := []struct {
+		failed   *task
+		task     *task
+		expected bool
+	}{
+		{assets, app, false},
+		{assets, nil, false},
+		{assets, restart, false},
+		{server, restart, true},
+		{server, app, false},
+		{server, nil, true},
+		{app, app, false},
+		{app, nil, true},
+	}
+	for i, test := range tests {
+		g.failures = map[*task]*failure{test.failed: {}}
+		if g.failed(test.task) != test.expected {
+			t.Fatalf("%d: failed should be %v", i, test.expected)
+		}
+	}
+}
+
+func TestCaptureStderr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+	var buf bytes.Buffer
+	g := New()
+	g.Logger = log.New(&buf, "", 0)
+
+	j := &job{}
+	if !g.externalCommand("echo fine 1>&2", j) {
+		t.Fatal("Should be succeeded")
+	}
+	if j.output != "" {
+		t.Fatalf("Should not keep output of succeeded command: %v", j.output)
+	}
+	if g.externalCommand("echo main.go:1:1: oops 1>&2; exit 1", j) {
+		t.Fatal("Should not be succeeded")
+	}
+	if j.output != "main.go:1:1: oops\n" {
+		t.Fatalf("Should capture stderr of failed command: %q", j.output)
+	}
+
+	j = &job{files: []string{"a.go"}}
+	if g.internalCommand(":foreach echo boom 1>&2; false", j) {
+		t.Fatal("Should not be succeeded")
+	}
+	if j.output != "boom\n" {
+		t.Fatalf("Should capture stderr of failed sub-command: %q", j.output)
+	}
+}
+
+func TestTail(t *testing.T) {
+	tests := []struct {
+		s        string
+		n        int
+		expected string
+	}{
+		{"abc", 5, "abc"},
+		{"abc", 2, "bc"},
+		{"aあい", 4, "い"},
+		{"aあい", 6, "あい"},
+		{"aあい", 7, "aあい"},
+	}
+	for _, test := range tests {
+		if s := tail(test.s, test.n); s != test.expected {
+			t.Fatalf("tail(%q, %d) should be %q but %q", test.s, test.n, test.expected, s)
+		}
+	}
+}
+
+func TestStylesheets(t *testing.T) {
+	g := New()
+
+	css, _ := filepath.Abs("assets/app.css")
+	js, _ := filepath.Abs("assets/app.js")
+	css = filepath.ToSlash(css)
+	js = filepath.ToSlash(js)
+
+	paths := g.stylesheets(&job{file: css, files: []string{css}})
+	if len(paths) != 1 || paths[0] != "/assets/app.css" {
+		t.Fatalf("Should be relative asset path: %v", paths)
+	}
+	if paths := g.stylesheets(&job{file: js, files: []string{css, js}}); paths != nil {
+		t.Fatalf("Should reload whole page when other file changed: %v", paths)
+	}
+	if !commandRe.MatchString(":livereload-css") {
+		t.Fatal("Should be internal command")
+	}
+}
+
+func TestInjectLiveReload(t *testing.T) {
+	g := New()
+	g.conf.LiveReload = ":35730"
+
+	h := g.InjectLiveReload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Content-Length", "38")
+			w.Write([]byte("<html><body><p>hello</p></BODY></html>"))
+		case "/app.js":
+			w.Header().Set("Content-Type", "application/javascript")
+			w.Write([]byte("</body>"))
+		}
+	}))
+
+	tag := `<script src="//example.com:35730/livereload.js"></script>`
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/index.html", "<html><body><p>hello</p>" + tag + "</BODY></html>"},
+		{"/app.js", "</body>"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com:5000"+test.path, nil))
+		if w.Body.String() != test.body {
+			t.Fatalf("Should be %q but %q", test.body, w.Body.String())
+		}
+		if cl := w.Header().Get("Content-Length"); cl != "" && cl != strconv.Itoa(len(test.body)) {
+			t.Fatalf("Should not send wrong Content-Length: %v", cl)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	g := New()
+	g.conf.LiveReload = ":35730"
+	g.conf.Proxy.Upstream = addr
+	g.conf.Proxy.Timeout = 5000
+	h, err := g.proxyHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// upstream starts after the request arrived like restarting app
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<body></body>"))
+		}))
+	}()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8000/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Should hold request until upstream is ready: %v %v", w.Code, w.Body.String())
+	}
+	expected := `<body><script src="//localhost:35730/livereload.js"></script></body>`
+	if w.Body.String() != expected {
+		t.Fatalf("Should inject livereload script: %v", w.Body.String())
+	}
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.conf.Proxy.Upstream = l.Addr().String()
+	g.conf.Proxy.Timeout = 200
+	l.Close()
+	h, err = g.proxyHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8000/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Should give up after the timeout: %v", w.Code)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	var buf bytes.Buffer
+	g := New()
+	g.Logger = log.New(&buf, "", 0)
+
+	if g.internalCommand(":wait-ready abc", &job{}) {
+		t.Fatal("Should not be succeeded")
+	}
+
+	g.conf.Ready.lre = regexp.MustCompile(`listening on :\d+`)
+	lw := &logWriter{w: &buf, re: g.conf.Ready.lre, ready: g.readyChan(false)}
+	lw.Write([]byte("starting\nlisten"))
+	if g.waitReady(100*time.Millisecond) == nil {
+		t.Fatal("Should not be ready before the log")
+	}
+	lw.Write([]byte("ing on :8080\n"))
+	if err := g.waitReady(100 * time.Millisecond); err != nil {
+		t.Fatal("Should be ready after the log", err)
+	}
+	g.conf.Ready.lre = nil
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.conf.Ready.TCP = l.Addr().String()
+	if err := g.waitReady(time.Second); err != nil {
+		t.Fatal("Should be ready", err)
+	}
+	l.Close()
+	if g.waitReady(200*time.Millisecond) == nil {
+		t.Fatal("Should not be ready")
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw := &prefixWriter{w: &buf, prefix: "[api] "}
+	pw.Write([]byte("hello\nwor"))
+	pw.Write([]byte("ld\nbye"))
+	pw.flush()
+	expected := "[api] hello\n[api] world\n[api] bye\n"
+	if buf.String() != expected {
+		t.Fatalf("Should prefix each line: %q", buf.String())
+	}
+}
+
+func TestSortProcesses(t *testing.T) {
+	procs := map[string]*process{
+		"worker":  {DependsOn: []string{"api", "migrate"}},
+		"api":     {DependsOn: []string{"migrate"}},
+		"migrate": {},
+		"web":     {},
+	}
+	names, err := sortProcesses(procs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "migrate,api,web,worker" {
+		t.Fatalf("Should be sorted by dependencies: %v", names)
+	}
+
+	procs["migrate"].DependsOn = []string{"worker"}
+	if _, err := sortProcesses(procs); err == nil {
+		t.Fatal("Should detect circular dependency")
+	}
+
+	procs["migrate"].DependsOn = []string{"db"}
+	if _, err := sortProcesses(procs); err == nil {
+		t.Fatal("Should detect unknown process")
+	}
+}
+
+func TestRestartPolicy(t *testing.T) {
+	rp := &restartPolicy{Backoff: 100, BackoffMax: 1000}
+	tests := []struct {
+		retries int
+		delay   time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	}
+	for _, test := range tests {
+		if d := rp.delay(test.retries); d != test.delay {
+			t.Fatalf("delay for %d retries should be %v but %v", test.retries, test.delay, d)
+		}
+	}
+
+	for _, policy := range []string{"", "always"} {
+		rp.RestartPolicy = policy
+		if !rp.respawn(nil) || !rp.respawn(errors.New("exit status 1")) {
+			t.Fatalf("%q should always respawn", policy)
+		}
+	}
+	rp.RestartPolicy = "on-failure"
+	if rp.respawn(nil) || !rp.respawn(errors.New("exit status 1")) {
+		t.Fatal("on-failure should respawn only for failure")
+	}
+	rp.RestartPolicy = "never"
+	if rp.respawn(errors.New("exit status 1")) {
+		t.Fatal("never should not respawn")
+	}
+
+	if rp.exhausted(100) {
+		t.Fatal("Should retry forever without max_retries")
+	}
+	rp.MaxRetries = 2
+	if rp.exhausted(2) || !rp.exhausted(3) {
+		t.Fatal("Should give up after max_retries")
+	}
+}
+
+func TestRestartIfChanged(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bin := filepath.Join(dir, "app")
+	conf := filepath.Join(dir, "goemon.yml")
+	ioutil.WriteFile(conf, []byte(`
+tasks:
+- match: './*.go'
+  commands:
+  - :restart-if-changed `+filepath.ToSlash(bin)+`
+`), 0644)
+
+	var buf bytes.Buffer
+	g := New()
+	g.Logger = log.New(&buf, "", 0)
+	g.File = conf
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+	g.Args = shell("exit 0")
+
+	tests := []struct {
+		content string
+		failed  bool
+		skip    bool
+	}{
+		{"v1", false, false},
+		{"v1", false, true},
+		{"v2", true, false},
+		// v2 was not spawned since the restart was blocked
+		{"v2", false, false},
+		{"v2", false, true},
+	}
+	for i, test := range tests {
+		ioutil.WriteFile(bin, []byte(test.content), 0755)
+		g.failures = nil
+		if test.failed {
+			g.failures = map[*task]*failure{g.conf.Tasks[0]: {}}
+		}
+		j := &job{}
+		if !g.internalCommand(":restart-if-changed "+bin, j) {
+			t.Fatal("Should be succeeded")
+		}
+		if j.skip != test.skip {
+			t.Fatalf("%d: skip should be %v", i, test.skip)
+		}
+		if !test.skip && !test.failed {
+			if err := g.spawn(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if g.internalCommand(":restart-if-changed "+filepath.Join(dir, "missing"), &job{}) {
+		t.Fatal("Should be failed for missing file")
+	}
+	if !strings.Contains(buf.String(), "not changed, skipping restart") {
+		t.Fatalf("Should log the decision: %v", buf.String())
+	}
+}
+
+func TestParseBuildOutput(t *testing.T) {
+	out := `{"ImportPath":"x","Action":"build-output","Output":"# x\n"}
+{"ImportPath":"x","Action":"build-output","Output":"./main.go:2:14: declared and not used: x\n"}
+{"ImportPath":"x","Action":"build-output","Output":"./main.go:3:2: cannot use y\n\thave int\n\twant string\n"}
+{"ImportPath":"x","Action":"build-fail"}
+go: warning: something
+sub/b.go:10: plain error
+`
+	diags, output := parseBuildOutput(strings.NewReader(out))
+	expected := []diagnostic{
+		{File: "./main.go", Line: 2, Col: 14, Message: "declared and not used: x"},
+		{File: "./main.go", Line: 3, Col: 2, Message: "cannot use y\n\thave int\n\twant string"},
+		{File: "sub/b.go", Line: 10, Message: "plain error"},
+	}
+	if !reflect.DeepEqual(diags, expected) {
+		t.Fatalf("Should be parsed as %v but %v", expected, diags)
+	}
+	if !strings.HasPrefix(output, "# x\n./main.go:2:14") || !strings.Contains(output, "go: warning: something\n") {
+		t.Fatalf("Should keep the output: %q", output)
+	}
+}
+
+func TestGoBuild(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/app\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {\n\tundefined()\n}\n"), 0644)
+
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(cwd)
+
+	g := New()
+	g.Logger = log.New(ioutil.Discard, "", 0)
+	j := &job{}
+	if g.internalCommand(":gobuild . -o app", j) {
+		t.Fatal("Should be failed")
+	}
+	if len(j.diagnostics) != 1 || j.diagnostics[0].Line != 4 || j.diagnostics[0].Col != 2 {
+		t.Fatalf("Should report the diagnostic: %v", j.diagnostics)
+	}
+	if !strings.Contains(j.output, "main.go:4:2: undefined: undefined") {
+		t.Fatalf("Should keep the output for the overlay: %q", j.output)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {\n}\n"), 0644)
+	j = &job{}
+	if !g.internalCommand(":gobuild -o app", j) {
+		t.Fatal("Should be succeeded", j.output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app")); err != nil {
+		t.Fatal("Should build the binary", err)
+	}
+}
+
+func TestGoBuildPlain(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+	// go before 1.24 does not support go build -json
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "go"), []byte(`#!/bin/sh
+case " $* " in
+*" -json "*) echo "flag provided but not defined: -json" 1>&2; exit 2;;
+esac
+echo "# example.com/app" 1>&2
+echo "./main.go:4:2: undefined: undefined" 1>&2
+exit 1
+`), 0755)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	g := New()
+	g.Logger = log.New(ioutil.Discard, "", 0)
+	for i := 0; i < 2; i++ {
+		j := &job{}
+		if g.internalCommand(":gobuild", j) {
+			t.Fatal("Should be failed")
+		}
+		if len(j.diagnostics) != 1 || j.diagnostics[0].Line != 4 || j.diagnostics[0].Col != 2 {
+			t.Fatalf("Should report the diagnostic from plain output: %v", j.diagnostics)
+		}
+	}
+	if atomic.LoadUint32(&g.plainBuild) != 1 {
+		t.Fatal("Should remember that -json is not supported")
+	}
+}
+
+func TestGoTest(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"go.mod":      "module example.com/app\n",
+		"a/a.go":      "package a\n\nfunc A() int { return 1 }\n",
+		"a/a_test.go": "package a\n\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n",
+		"b/b.go":      "package b\n\nimport \"example.com/app/a\"\n\nfunc B() int { return a.A() }\n",
+		"b/b_test.go": "package b\n\nimport \"testing\"\n\nfunc TestB(t *testing.T) {\n\tif B() != 2 {\n\t\tt.Fatal(\"bad\")\n\t}\n}\n",
+		"c/c.go":      "package c\n",
+		"c/c_test.go": "package c\n\nimport (\n\t\"testing\"\n\n\t\"example.com/app/b\"\n)\n\nfunc TestC(t *testing.T) { b.B() }\n",
+		"d/d_test.go": "package d\n\nimport \"testing\"\n\nfunc TestD(t *testing.T) {}\n",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(cwd)
+
+	pkgs, err := affectedPackages(map[string]bool{filepath.Join(dir, "a"): true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"example.com/app/a", "example.com/app/b", "example.com/app/c"}
+	if !reflect.DeepEqual(pkgs, expected) {
+		t.Fatalf("Should be affected %v but %v", expected, pkgs)
+	}
+
+	g := New()
+	g.Logger = log.New(ioutil.Discard, "", 0)
+	j := &job{files: []string{filepath.Join(dir, "a", "a.go")}}
+	if g.internalCommand(":gotest", j) {
+		t.Fatal("Should be failed")
+	}
+	if !strings.Contains(j.output, "b_test.go:7: bad") {
+		t.Fatalf("Should keep the output of the failed test: %q", j.output)
+	}
+
+	j = &job{files: []string{filepath.Join(dir, "d", "d_test.go")}}
+	if !g.internalCommand(":gotest -count=1", j) {
+		t.Fatal("Should be succeeded", j.output)
+	}
+}
+
+func TestParseTestOutput(t *testing.T) {
+	out := `{"Action":"start","Package":"x"}
+{"Action":"run","Package":"x","Test":"TestA"}
+{"Action":"output","Package":"x","Test":"TestA","Output":"=== RUN   TestA\n"}
+{"Action":"pass","Package":"x","Test":"TestA","Elapsed":0}
+{"Action":"run","Package":"x","Test":"TestB"}
+{"Action":"output","Package":"x","Test":"TestB","Output":"    x_test.go:4: bad\n"}
+{"Action":"fail","Package":"x","Test":"TestB","Elapsed":0}
+{"Action":"fail","Package":"x","Elapsed":0.003}
+{"ImportPath":"y [y.test]","Action":"build-output","Output":"./y.go:1:1: oops\n"}
+{"Action":"output","Package":"y","Output":"FAIL\ty [build failed]\n"}
+{"Action":"fail","Package":"y","Elapsed":0}
+{"Action":"pass","Package":"z","Elapsed":0.5}
+`
+	results, output := parseTestOutput(strings.NewReader(out))
+	var summary []string
+	for _, r := range results {
+		summary = append(summary, r.String())
+	}
+	expected := []string{"FAIL x (TestB)", "FAIL y", "ok   z (0.50s)"}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("Should be summarized as %v but %v", expected, summary)
+	}
+	if output != "    x_test.go:4: bad\n./y.go:1:1: oops\nFAIL\ty [build failed]\n" {
+		t.Fatalf("Should keep the output of the failures: %q", output)
+	}
+}
+
+func TestGoMod(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	files := map[string]string{
+		"go.work":          "go 1.21\n\nuse (\n\t./app\n\t./shared\n\t./tool\n)\n",
+		"app/go.mod":       "module example.com/app\n\ngo 1.21\n\nrequire example.com/lib v0.0.0\n\nreplace example.com/lib => ../lib\n",
+		"app/main.go":      "package main\n\nimport \"example.com/lib\"\n\nfunc main() { lib.F() }\n",
+		"app/main_test.go": "package main\n\nimport _ \"example.com/shared\"\n",
+		"lib/lib.go":       "package lib\n\nfunc F() {}\n",
+		"shared/go.mod":    "module example.com/shared\n\ngo 1.21\n",
+		"shared/shared.go": "package shared\n",
+		"app/goemon.yml":   "tasks:\n- match: './**/*.go'\n  gomod: true\n  commands:\n  - :sleep 1\n",
+		"lib/go.mod":       "module example.com/lib\n\ngo 1.21\n",
+		"tool/go.mod":      "module example.com/tool\n\ngo 1.21\n",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	cwd, _ := os.Getwd()
+	os.Chdir(filepath.Join(dir, "app"))
+	defer os.Chdir(cwd)
+	// -mod=mod is not allowed in workspace mode
+	defer os.Setenv("GOFLAGS", os.Getenv("GOFLAGS"))
+	os.Setenv("GOFLAGS", "")
+
+	var buf bytes.Buffer
+	g := New()
+	g.Logger = log.New(&buf, "", 0)
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+	// tool is in go.work, but app does not depend on it
+	expected := []string{filepath.Join(dir, "shared"), filepath.Join(dir, "lib")}
+	sort.Strings(expected)
+	sort.Strings(g.modules)
+	if !reflect.DeepEqual(g.modules, expected) {
+		t.Fatalf("Should watch %v but %v: %v", expected, g.modules, buf.String())
+	}
+	for _, f := range []string{"app/go.mod", "go.work"} {
+		if !g.modFiles[filepath.Join(dir, f)] {
+			t.Fatalf("Should watch %v: %v", f, g.modFiles)
+		}
+	}
+
+	tests := []struct {
+		file     string
+		expected bool
+	}{
+		{"app/main.go", true},
+		{"lib/lib.go", true},
+		{"lib/sub/sub.go", true},
+		{"shared/main.go", true},
+		{"tool/main.go", false},
+		{"lib/README.md", false},
+		{"other/main.go", false},
+	}
+	for _, test := range tests {
+		file := filepath.ToSlash(filepath.Join(dir, test.file))
+		if g.conf.Tasks[0].match(file) != test.expected {
+			t.Fatalf("%v: Should be %v", test.file, test.expected)
+		}
+	}
+}
+
+func TestWatchNewDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	os.MkdirAll(filepath.Join(dir, "cmd"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "cmd", "main.go"), []byte("package main\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, "docs"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "docs", "README.txt"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "goemon.yml"), []byte("tasks:\n- match: './**/*.go'\n  commands:\n  - :sleep 1\n"), 0644)
+
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(cwd)
+
+	g := New()
+	g.Logger = log.New(ioutil.Discard, "", 0)
+	if err := g.load(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- g.watch()
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	wait := func(n uint64) {
+		for i := 0; i < 50 && atomic.LoadUint64(&g.changes) <= n; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if atomic.LoadUint64(&g.changes) <= n {
+			t.Fatal("Should fire the task for the file in new directory")
+		}
+	}
+
+	os.MkdirAll(filepath.Join(dir, "internal", "newpkg"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "internal", "newpkg", "foo.go"), []byte("package newpkg\n"), 0644)
+	wait(0)
+
+	n := atomic.LoadUint64(&g.changes)
+	time.Sleep(100 * time.Millisecond)
+	ioutil.WriteFile(filepath.Join(dir, "internal", "newpkg", "foo.go"), []byte("package newpkg\n\n"), 0644)
+	wait(n)
+
+	// the directory without matched files is watched too
+	n = atomic.LoadUint64(&g.changes)
+	os.MkdirAll(filepath.Join(dir, "docs", "api"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "docs", "api", "x.go"), []byte("package api\n"), 0644)
+	wait(n)
+
+	os.RemoveAll(filepath.Join(dir, "internal"))
+	time.Sleep(300 * time.Millisecond)
+
+	ioutil.WriteFile(filepath.Join(dir, "goemon.yml"), []byte("tasks:\n"), 0644)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Should be reloaded")
+	}
+	for path := range g.watched {
+		if strings.HasPrefix(path, filepath.Join(dir, "internal")) {
+			t.Fatalf("Should not watch removed directory: %v", path)
+		}
+	}
+	if !g.watched[filepath.Join(dir, "cmd")] {
+		t.Fatal("Should watch the directory of matched file")
+	}
+}
+
+func TestWatchTaskDir(t *testing.T) {
+	dir := t.TempDir()
+	dir, _ = filepath.EvalSymlinks(dir)
+	os.MkdirAll(filepath.Join(dir, "app"), 0755)
+	os.MkdirAll(filepath.Join(dir, "shared", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "shared", "sub", "lib.go"), []byte("package sub\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "app", "goemon.yml"), []byte("tasks:\n- match: './**/*.go'\n  dir: ../shared\n  commands:\n  - :sleep 1\n"), 0644)
+
+	cwd, _ := os.Getwd()
+	os.Chdir(filepath.Join(dir, "app"))
+	defer os.Chdir(cwd)
+
+	g := New()
+	g.Logger = log.New(ioutil.Discard, "", 0)
+	if err := g.load(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- g.watch()
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	ioutil.WriteFile(filepath.Join(dir, "shared", "sub", "lib.go"), []byte("package sub\n\n"), 0644)
+	for i := 0; i < 50 && atomic.LoadUint64(&g.changes) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if atomic.LoadUint64(&g.changes) == 0 {
+		t.Fatal("Should fire the task for the file in dir outside of current directory")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "app", "goemon.yml"), []byte("tasks:\n"), 0644)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Should be reloaded")
+	}
+	if !g.watched[filepath.Join(dir, "shared", "sub")] {
+		t.Fatal("Should watch the directory under dir of the task")
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	files := map[string]string{
+		".git/HEAD":                       "",
+		".gitignore":                      "# comment\nnode_modules/\n*.log\n!keep.log\n/build\ndocs/**/*.html\n",
+		".goemonignore":                   "vendor/\n",
+		"sub/.gitignore":                  "*.tmp\n!important.tmp\n",
+		"main.go":                         "",
+		"app.log":                         "",
+		"keep.log":                        "",
+		"node_modules/pkg/index.js":       "",
+		"build/app.go":                    "",
+		"sub/build/app.go":                "",
+		"sub/a.tmp":                       "",
+		"sub/important.tmp":               "",
+		"a.tmp":                           "",
+		"vendor/lib/lib.go":               "",
+		"dist/bundle.js":                  "",
+		"docs/guide/index.html":           "",
+		"docs/guide/index.md":             "",
+		"sub/node_modules/foo/foo.go":     "",
+		"sub/node_modules.go":             "",
+		"sub/dir/node_modules/bar/bar.go": "",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	ig := newIgnorer(dir, []string{"dist/", "!dist/keep.js"})
+	tests := []struct {
+		file     string
+		expected bool
+	}{
+		{"main.go", false},
+		{"app.log", true},
+		{"keep.log", false},
+		{"node_modules/pkg/index.js", true},
+		{"build/app.go", true},
+		{"sub/build/app.go", false},
+		{"sub/a.tmp", true},
+		{"sub/important.tmp", false},
+		{"a.tmp", false},
+		{"vendor/lib/lib.go", true},
+		{"dist/bundle.js", true},
+		{"docs/guide/index.html", true},
+		{"docs/guide/index.md", false},
+		{"sub/node_modules/foo/foo.go", true},
+		{"sub/node_modules.go", false},
+		{"sub/dir/node_modules/bar/bar.go", true},
+		{".git/HEAD", true},
+	}
+	for _, test := range tests {
+		if ig.ignored(filepath.Join(dir, test.file), false) != test.expected {
+			t.Fatalf("%v: Should be ignored %v", test.file, test.expected)
+		}
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "sub", ".gitignore"), []byte(""), 0644)
+	ig.reset(filepath.Join(dir, "sub"))
+	if ig.ignored(filepath.Join(dir, "sub", "a.tmp"), false) {
+		t.Fatal("Should reload .gitignore")
+	}
+
+	// without .git, the ignore files above the root are not applied
+	outer := t.TempDir()
+	os.MkdirAll(filepath.Join(outer, "work", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(outer, ".gitignore"), []byte("*.go\n"), 0644)
+	ioutil.WriteFile(filepath.Join(outer, "work", ".gitignore"), []byte("*.log\n"), 0644)
+	oig := newIgnorer(filepath.Join(outer, "work"), nil)
+	if oig.ignored(filepath.Join(outer, "work", "sub", "main.go"), false) {
+		t.Fatal("Should not apply .gitignore above the root")
+	}
+	if !oig.ignored(filepath.Join(outer, "work", "sub", "app.log"), false) {
+		t.Fatal("Should apply .gitignore in the root")
+	}
+
+	// the global ignore list is applied to the roots outside of the working
+	// directory too
+	shared := filepath.Join(outer, "shared")
+	os.MkdirAll(filepath.Join(shared, ".git"), 0755)
+	os.MkdirAll(filepath.Join(shared, "node_modules"), 0755)
+	sig := newIgnorer(filepath.Join(outer, "work"), []string{"node_modules/"})
+	sig.addRoot(shared)
+	for _, d := range []string{".git", "node_modules"} {
+		if !sig.ignored(filepath.Join(shared, d), true) {
+			t.Fatalf("Should ignore %v in the root outside of the working directory", d)
+		}
+	}
+
+	g := New()
+	g.Logger = log.New(ioutil.Discard, "", 0)
+	all, _ := compilePattern("%.")
+	g.conf.Tasks = []*task{{mre: all}}
+	g.fsw, err = newWatcher("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.fsw.Close()
+	g.watched = map[string]bool{}
+	g.ign = ig
+	g.walk(dir)
+	for _, d := range []string{"node_modules", "node_modules/pkg", "vendor/lib", ".git", "build"} {
+		if g.watched[filepath.Join(dir, d)] {
+			t.Fatalf("Should not watch ignored directory: %v", d)
+		}
+	}
+	if !g.watched[filepath.Join(dir, "sub", "build")] {
+		t.Fatal("Should watch the directory which is not ignored")
+	}
+}
+
+func TestPollWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	file := filepath.Join(dir, "foo.txt")
+	ioutil.WriteFile(file, []byte("foo"), 0644)
+
+	w, err := newWatcher("poll", 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add(dir, fswatcher.All); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(name string, op fswatcher.Op) {
+		select {
+		case ev := <-w.Events():
+			if ev.Name != name || ev.Op != op {
+				t.Fatalf("Should be %v %v but %v", name, op, ev)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Should be notified %v %v", name, op)
+		}
+	}
+	mtime := time.Now().Add(-time.Hour)
+
+	ioutil.WriteFile(file, []byte("foobar"), 0644)
+	expect(file, fswatcher.Write)
+
+	// same size, different content
+	tmp := dir + ".tmp"
+	ioutil.WriteFile(tmp, []byte("barfoo"), 0644)
+	os.Chtimes(tmp, mtime, mtime)
+	os.Rename(tmp, file)
+	expect(file, fswatcher.Write)
+
+	// only the time is changed
+	mtime = mtime.Add(time.Minute)
+	os.Chtimes(file, mtime, mtime)
+	expect(file, fswatcher.Chmod)
+
+	os.Chmod(file, 0600)
+	expect(file, fswatcher.Chmod)
+
+	bar := filepath.Join(dir, "bar.txt")
+	ioutil.WriteFile(bar, []byte("bar"), 0644)
+	expect(bar, fswatcher.Create)
+
+	os.Remove(file)
+	expect(file, fswatcher.Remove)
+
+	w.Remove(dir)
+	ioutil.WriteFile(bar, []byte("barbar"), 0644)
+	select {
+	case ev := <-w.Events():
+		t.Fatalf("Should not be notified after removed: %v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := newWatcher("foo", 0); err == nil {
+		t.Fatal("Should be failed for unknown watcher")
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "goemon.yml")
+	ioutil.WriteFile(tmp, []byte(`
+tasks:
+- match: '`+filepath.ToSlash(dir)+`/*.txt'
+  skip_unchanged: true
+  commands:
+  - :sleep 1
+- match: '`+filepath.ToSlash(dir)+`/*.log'
+  commands:
+  - :sleep 1
+`), 0644)
+
+	g := New()
+	g.Logger = log.New(ioutil.Discard, "", 0)
+	g.File = tmp
+	if err := g.load(); err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+
+	fire := func(file, content string, op fswatcher.Op) bool {
+		if content != "" {
+			ioutil.WriteFile(file, []byte(content), 0644)
+		}
+		for i := 0; i < 50 && atomic.LoadUint64(&g.tasks) > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		n := atomic.LoadUint64(&g.changes)
+		g.task(fswatcher.Event{Name: file, Op: op})
+		return atomic.LoadUint64(&g.changes) > n
+	}
+
+	txt := filepath.Join(dir, "a.txt")
+	tests := []struct {
+		file     string
+		content  string
+		op       fswatcher.Op
+		expected bool
+	}{
+		{txt, "foo", fswatcher.Create, true},
+		{txt, "foo", fswatcher.Write, false},
+		{txt, "", fswatcher.Chmod, false},
+		{txt, "bar", fswatcher.Write, true},
+		{txt, "bar", fswatcher.Write, false},
+		{filepath.Join(dir, "a.log"), "foo", fswatcher.Write, true},
+		{filepath.Join(dir, "a.log"), "foo", fswatcher.Write, true},
+	}
+	for i, test := range tests {
+		if fire(test.file, test.content, test.op) != test.expected {
+			t.Fatalf("%d: %v %v should be fired %v", i, test.file, test.op, test.expected)
+		}
+	}
+
+	hc := &hashCache{max: 2}
+	for _, name := range []string{"a", "b", "c"} {
+		hc.set(name, name)
+	}
+	if len(hc.items) != 2 || hc.set("a", "a") != "" || hc.set("c", "c") != "c" {
+		t.Fatal("Should evict the least recently used hash")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "goemon.yml")
+	ioutil.WriteFile(file, []byte(`livereload: :35730
+stop_signal: SIGFOO
+tasks:
+- match: './assets/*.js'
+  comands:
+  - :livereload /
+- match: './assets/[abc.js'
+  ops: [write, move]
+  on_busy: wait
+  commands:
+  - :sleep abc
+  - :reload /
+  - :foreach :wait-ready x
+  - :restart
+  - :gobuild -bogus
+- match:
+  - './**/*.go'
+  - '{a,b'
+  commands:
+  - go build
+`), 0644)
+
+	var msgs []string
+	for _, err := range Check(file) {
+		msgs = append(msgs, strings.TrimPrefix(err.Error(), file+":"))
+	}
+	expected := []string{
+		`2:14: unknown signal SIGFOO`,
+		`5:3: unknown field "comands"`,
+		`7:10: invalid wildcard: ./assets/[abc.js: missing ]`,
+		`8:16: unknown operation "move"`,
+		`9:12: unknown on_busy policy "wait"`,
+		`11:5: invalid argument for :sleep command: "abc"`,
+		`12:5: unknown internal command :reload`,
+		`13:5: invalid argument for :wait-ready command: "x"`,
+		`15:5: unknown flag for :gobuild command: -bogus`,
+		`18:5: invalid wildcard: {a,b: missing }`,
+	}
+	if runtime.GOOS == "windows" {
+		expected = expected[1:]
+		msgs = msgs[1:]
+	}
+	if !reflect.DeepEqual(msgs, expected) {
+		t.Fatalf("Should report errors:\n%v\nbut:\n%v", strings.Join(expected, "\n"), strings.Join(msgs, "\n"))
+	}
+
+	ioutil.WriteFile(file, []byte("tasks:\n- match: './*.go'\n  commands: foo\n"), 0644)
+	errs := Check(file)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), file+":3: ") {
+		t.Fatalf("Should report type error with line: %v", errs)
+	}
+
+	ioutil.WriteFile(file, []byte("tasks:\n- match:\n  - '!./**/*_test.go'\n  commands:\n  - go test\n"), 0644)
+	errs = Check(file)
+	if len(errs) != 1 || !strings.HasSuffix(errs[0].Error(), "only negated globs") {
+		t.Fatalf("Should reject match without positive glob: %v", errs)
+	}
+
+	ioutil.WriteFile(file, []byte("socket: :8080\n"), 0644)
+	errs = Check(file)
+	if len(errs) != 1 || !strings.HasSuffix(errs[0].Error(), ":1:9: socket requires ready probe") {
+		t.Fatalf("Should require ready probe for socket: %v", errs)
+	}
+
+	ioutil.WriteFile(file, []byte("tasks:\n- match: './*.go'\n  commands:\n  - :restart\n"), 0644)
+	if errs := Check(file); len(errs) != 0 {
+		t.Fatalf("Should be valid: %v", errs)
+	}
+}
@@ -0,0 +1,192 @@
+package goemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// goModFile is the go.mod or go.work printed by `go mod edit -json`
+type goModFile struct {
+	Replace []struct {
+		Old struct {
+			Path string
+		}
+		New struct {
+			Path    string
+			Version string
+		}
+	}
+}
+
+// goModules return the directories of the local modules which the main
+// module depends on: the modules in go.work and the local replacements. It
+// also return go.mod and go.work files to watch.
+func goModules() ([]string, []string, error) {
+	b, err := goCommand("env", "GOMOD")
+	if err != nil {
+		return nil, nil, err
+	}
+	gomod := strings.TrimSpace(string(b))
+	if gomod == "" || gomod == os.DevNull {
+		return nil, nil, errors.New("go.mod is not found for gomod")
+	}
+	deps, err := goModDeps()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var dirs, files []string
+	dup := map[string]bool{}
+	addDir := func(dir string) {
+		dir = filepath.Clean(dir)
+		if !dup[dir] {
+			dup[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	addReplace := func(mod string, args ...string) error {
+		b, err := goCommand(args...)
+		if err != nil {
+			return err
+		}
+		var mf goModFile
+		if err := json.Unmarshal(b, &mf); err != nil {
+			return err
+		}
+		for _, r := range mf.Replace {
+			// a replacement without version is a directory
+			if r.New.Version != "" || !deps[r.Old.Path] {
+				continue
+			}
+			dir := filepath.FromSlash(r.New.Path)
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(filepath.Dir(mod), dir)
+			}
+			addDir(dir)
+		}
+		return nil
+	}
+
+	b, err = goCommand("list", "-m", "-json")
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var m struct {
+			Path  string
+			Dir   string
+			GoMod string
+		}
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		// the modules in go.work which the main module does not depend on
+		// are not watched
+		if m.Dir == "" || m.GoMod == "" || (m.GoMod != gomod && !deps[m.Path]) {
+			continue
+		}
+		addDir(m.Dir)
+		files = append(files, m.GoMod)
+		if err := addReplace(m.GoMod, "mod", "edit", "-json", m.GoMod); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	b, err = goCommand("env", "GOWORK")
+	if err != nil {
+		return nil, nil, err
+	}
+	if work := strings.TrimSpace(string(b)); work != "" && work != "off" {
+		files = append(files, work)
+		if err := addReplace(work, "work", "edit", "-json", work); err != nil {
+			return nil, nil, err
+		}
+	}
+	return dirs, files, nil
+}
+
+// goModDeps return the paths of the modules which the packages of the main
+// module import directly or indirectly, including their tests.
+func goModDeps() (map[string]bool, error) {
+	b, err := goCommand("list", "-e", "-deps", "-test", "-f", "{{with .Module}}{{.Path}}{{end}}", "./...")
+	if err != nil {
+		return nil, err
+	}
+	deps := map[string]bool{}
+	for _, path := range strings.Fields(string(b)) {
+		deps[path] = true
+	}
+	return deps, nil
+}
+
+func goCommand(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return b, nil
+}
+
+// loadModules resolve the local modules for the tasks with gomod, and
+// compile the patterns of the tasks for them.
+func (g *Goemon) loadModules() {
+	gomod := false
+	for _, t := range g.conf.Tasks {
+		gomod = gomod || t.GoMod
+	}
+	if !gomod {
+		g.modules, g.modFiles = nil, nil
+		return
+	}
+	dirs, files, err := goModules()
+	if err != nil {
+		g.Logger.Println(err)
+		return
+	}
+	root, _ := filepath.Abs(".")
+	g.modules = nil
+	for _, dir := range dirs {
+		if dir != root {
+			g.modules = append(g.modules, dir)
+		}
+	}
+	g.modFiles = map[string]bool{}
+	for _, f := range files {
+		g.modFiles[f] = true
+	}
+	for _, t := range g.conf.Tasks {
+		if !t.GoMod || t.mre == nil {
+			continue
+		}
+		var mres, ires []*wildcard
+		for _, dir := range g.modules {
+			mre, err := t.Match.compile(dir)
+			if err != nil {
+				g.Logger.Println(err)
+				continue
+			}
+			ire := t.ire
+			if len(t.Ignore) > 0 {
+				if ire, err = t.Ignore.compile(dir); err != nil {
+					g.Logger.Println(err)
+				}
+			}
+			mres = append(mres, mre)
+			ires = append(ires, ire)
+		}
+		t.gmre, t.gire = mres, ires
+	}
+}
@@ -0,0 +1,213 @@
+package goemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// goPackage is the package listed by `go list -json`
+type goPackage struct {
+	ImportPath   string
+	Dir          string
+	Imports      []string
+	TestImports  []string
+	XTestImports []string
+}
+
+// affectedPackages return the packages in dirs, and the packages which
+// import them directly or indirectly, or whose tests import them.
+func affectedPackages(dirs map[string]bool) ([]string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", "list", "-e", "-json=ImportPath,Dir,Imports,TestImports,XTestImports", "./...")
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %v: %s", err, stderr.String())
+	}
+	importers := map[string][]string{}
+	testers := map[string][]string{}
+	var queue []string
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var p goPackage
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		for _, imp := range p.Imports {
+			importers[imp] = append(importers[imp], p.ImportPath)
+		}
+		for _, imp := range append(p.TestImports, p.XTestImports...) {
+			testers[imp] = append(testers[imp], p.ImportPath)
+		}
+		if dirs[p.Dir] {
+			queue = append(queue, p.ImportPath)
+		}
+	}
+
+	affected := map[string]bool{}
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		if affected[pkg] {
+			continue
+		}
+		affected[pkg] = true
+		queue = append(queue, importers[pkg]...)
+	}
+	// tests of the package are affected, but the importers of it are not
+	for pkg := range affected {
+		for _, t := range testers[pkg] {
+			affected[t] = true
+		}
+	}
+
+	var pkgs []string
+	for pkg := range affected {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	return pkgs, nil
+}
+
+// testEvent is the line of `go test -json`
+type testEvent struct {
+	ImportPath string
+	Action     string
+	Package    string
+	Test       string
+	Output     string
+	Elapsed    float64
+}
+
+// testResult is the result of the tests of the package
+type testResult struct {
+	pkg     string
+	action  string
+	elapsed float64
+	failed  []string
+}
+
+func (r *testResult) String() string {
+	switch r.action {
+	case "pass":
+		return fmt.Sprintf("ok   %s (%.2fs)", r.pkg, r.elapsed)
+	case "skip":
+		return fmt.Sprintf("?    %s [no test files]", r.pkg)
+	}
+	if len(r.failed) == 0 {
+		return fmt.Sprintf("FAIL %s", r.pkg)
+	}
+	return fmt.Sprintf("FAIL %s (%s)", r.pkg, strings.Join(r.failed, ", "))
+}
+
+// parseTestOutput parse the output of `go test -json`, and return the
+// results of the packages, and the output of the failed tests and builds.
+func parseTestOutput(r io.Reader) ([]*testResult, string) {
+	var results []*testResult
+	byPkg := map[string]*testResult{}
+	outputs := map[string]*bytes.Buffer{}
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var ev testEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			out.WriteString(scanner.Text() + "\n")
+			continue
+		}
+		if ev.Action == "build-output" {
+			out.WriteString(ev.Output)
+			continue
+		}
+		if ev.Package == "" {
+			continue
+		}
+		res, ok := byPkg[ev.Package]
+		if !ok {
+			res = &testResult{pkg: ev.Package}
+			byPkg[ev.Package] = res
+			results = append(results, res)
+		}
+		key := ev.Package + " " + ev.Test
+		switch ev.Action {
+		case "output":
+			if outputs[key] == nil {
+				outputs[key] = &bytes.Buffer{}
+			}
+			outputs[key].WriteString(ev.Output)
+		case "pass", "skip":
+			if ev.Test == "" {
+				res.action = ev.Action
+				res.elapsed = ev.Elapsed
+			}
+		case "fail":
+			if ev.Test == "" {
+				res.action = ev.Action
+				res.elapsed = ev.Elapsed
+				if len(res.failed) == 0 && outputs[key] != nil {
+					// build failure or panic outside of the tests
+					out.Write(outputs[key].Bytes())
+				}
+			} else {
+				res.failed = append(res.failed, ev.Test)
+				if outputs[key] != nil {
+					out.Write(outputs[key].Bytes())
+				}
+			}
+		}
+	}
+	return results, out.String()
+}
+
+// goTestCommand run `go test` for the packages affected by the changed
+// files. args are passed to `go test`.
+func (g *Goemon) goTestCommand(j *job, args []string) bool {
+	dirs := map[string]bool{}
+	for _, f := range j.files {
+		if abs, err := filepath.Abs(f); err == nil {
+			dirs[filepath.Dir(abs)] = true
+		}
+	}
+	pkgs, err := affectedPackages(dirs)
+	if err != nil {
+		g.Logger.Println(err)
+		return false
+	}
+	if len(pkgs) == 0 {
+		g.Logger.Println("no packages affected")
+		return true
+	}
+
+	g.Logger.Println("testing", strings.Join(pkgs, " "))
+	var buf bytes.Buffer
+	cmd := exec.Command("go", append(append([]string{"test", "-json"}, args...), pkgs...)...)
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	err = g.runCommand(cmd, j)
+	results, output := parseTestOutput(&buf)
+	os.Stderr.WriteString(output)
+	for _, r := range results {
+		if r.action == "pass" || r.action == "skip" {
+			fmt.Fprintln(os.Stdout, color(r.String(), "32"))
+		} else {
+			fmt.Fprintln(os.Stdout, color(r.String(), "31"))
+		}
+	}
+	if err != nil {
+		g.Logger.Println(err)
+		j.diagnostics, _ = parseBuildOutput(strings.NewReader(output))
+		j.output = tail(output, maxOutput)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package goemon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// socket return the listening socket owned by goemon. It is passed to the
+// command, and kept open across restarts.
+func (g *Goemon) socket() (*os.File, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.sock != nil {
+		return g.sock, nil
+	}
+	l, err := net.Listen("tcp", g.conf.Socket)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, errors.New("socket should be TCP")
+	}
+	g.sock, err = tl.File()
+	if err != nil {
+		return nil, err
+	}
+	g.Logger.Println("listening", l.Addr())
+	return g.sock, nil
+}
+
+// canHandoff return true when the new command can be started before the
+// old one is stopped. The ready probe is required to know when to stop the
+// old one.
+func (g *Goemon) canHandoff() bool {
+	return g.conf.Socket != "" && g.conf.Ready.configured() && runtime.GOOS != "windows"
+}
+
+// handoff start new command with the socket, and stop the old command
+// after the new one get ready. So the connections are never refused.
+func (g *Goemon) handoff(sig os.Signal) error {
+	old := g.running()
+	if old == nil {
+		return g.terminate(sig)
+	}
+
+	prev := g.readyChan(false)
+	ready := g.readyChan(true)
+	// the previous command is still ready when handoff failed
+	keep := func() {
+		g.mutex.Lock()
+		g.ready = prev
+		g.mutex.Unlock()
+	}
+	hashes := g.hashArtifacts()
+	cmd, err := g.command()
+	if err == nil {
+		g.Logger.Println("starting new command", g.Args)
+		err = cmd.Start()
+	}
+	if err != nil {
+		keep()
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- g.conf.Ready.wait(g.conf.Ready.timeout(), ready)
+	}()
+	exited := false
+	select {
+	case err = <-errc:
+	case err = <-done:
+		exited = true
+		if err == nil {
+			err = errors.New("new command exited")
+		}
+	}
+	if err != nil {
+		g.Logger.Println("new command is not ready, keeping previous version:", err)
+		if !exited {
+			g.stop(cmd, os.Kill, 0)
+			<-done
+		}
+		keep()
+		return err
+	}
+
+	g.mutex.Lock()
+	g.next = &handoff{cmd: cmd, done: done}
+	g.setArtifacts(hashes)
+	g.mutex.Unlock()
+	g.Logger.Println("stopping previous command")
+	return g.shutdown(old, &g.conf.stopPolicy, sig)
+}
+
+// handoff is the command started by handoff, which the restart loop should
+// wait for instead of spawning new one.
+type handoff struct {
+	cmd  *exec.Cmd
+	done chan error
+}
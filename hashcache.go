@@ -0,0 +1,75 @@
+package goemon
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/fswatcher/fswatcher"
+)
+
+// maxHashes is the maximum number of the files of which hash is kept
+const maxHashes = 4096
+
+// hashCache keep the hash of the content of the files for skip_unchanged.
+// The least recently used one is evicted when it is full.
+type hashCache struct {
+	max   int
+	order *list.List
+	items map[string]*list.Element
+	mutex sync.Mutex
+}
+
+type hashEntry struct {
+	file string
+	hash string
+}
+
+// unchanged update the hash of the file by the event, and return true when
+// the event is a write which did not change the content.
+func (hc *hashCache) unchanged(event fswatcher.Event) bool {
+	if event.Op&(fswatcher.Remove|fswatcher.Rename) != 0 {
+		hc.set(event.Name, "")
+		return false
+	}
+	h, err := hashFile(event.Name)
+	if err != nil {
+		hc.set(event.Name, "")
+		return false
+	}
+	prev := hc.set(event.Name, h)
+	if event.Op&fswatcher.Create != 0 || event.Op&(fswatcher.Write|fswatcher.Chmod) == 0 {
+		return false
+	}
+	return prev == h
+}
+
+// set store the hash of the file, and return the previous one. Empty hash
+// remove the file.
+func (hc *hashCache) set(file, hash string) string {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	if hc.items == nil {
+		hc.order = list.New()
+		hc.items = map[string]*list.Element{}
+	}
+	prev := ""
+	if e, ok := hc.items[file]; ok {
+		prev = e.Value.(*hashEntry).hash
+		hc.order.Remove(e)
+		delete(hc.items, file)
+	}
+	if hash == "" {
+		return prev
+	}
+	hc.items[file] = hc.order.PushFront(&hashEntry{file: file, hash: hash})
+	max := hc.max
+	if max <= 0 {
+		max = maxHashes
+	}
+	for hc.order.Len() > max {
+		e := hc.order.Back()
+		hc.order.Remove(e)
+		delete(hc.items, e.Value.(*hashEntry).file)
+	}
+	return prev
+}
@@ -0,0 +1,261 @@
+package goemon
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFiles are the files which have the patterns of ignored files
+var ignoreFiles = []string{".gitignore", ".goemonignore"}
+
+// ignoreRule is the pattern of .gitignore
+type ignoreRule struct {
+	base    string
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+func (r *ignoreRule) match(path string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+	rel, err := filepath.Rel(r.base, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	return r.re.MatchString(filepath.ToSlash(rel))
+}
+
+// parseIgnore parse the lines of .gitignore in base
+func parseIgnore(base string, lines []string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r := ignoreRule{base: base}
+		if line[0] == '!' {
+			r.negate = true
+			line = line[1:]
+		} else if line[0] == '\\' {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		// the pattern without slash matches at any level
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		line = strings.TrimPrefix(line, "/")
+		re, err := regexp.Compile(ignoreRegexp(line))
+		if err != nil {
+			continue
+		}
+		r.re = re
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// ignoreRegexp convert the pattern of .gitignore to regular expression
+func ignoreRegexp(pattern string) string {
+	var buf strings.Builder
+	buf.WriteString("^")
+	rs := []rune(pattern)
+	for i := 0; i < len(rs); i++ {
+		switch rs[i] {
+		case '*':
+			if i+1 < len(rs) && rs[i+1] == '*' {
+				switch {
+				case (i == 0 || rs[i-1] == '/') && i+2 < len(rs) && rs[i+2] == '/':
+					buf.WriteString(`(?:.*/)?`)
+					i += 2
+					continue
+				case i > 0 && rs[i-1] == '/' && i+2 == len(rs):
+					buf.WriteString(`.*`)
+					i++
+					continue
+				}
+			}
+			buf.WriteString(`[^/]*`)
+		case '?':
+			buf.WriteString(`[^/]`)
+		case '[':
+			j := i + 1
+			if j < len(rs) && (rs[j] == '!' || rs[j] == '^') {
+				j++
+			}
+			if j < len(rs) && rs[j] == ']' {
+				j++
+			}
+			for j < len(rs) && rs[j] != ']' {
+				j++
+			}
+			if j >= len(rs) {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := string(rs[i+1 : j])
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i = j
+		case '\\':
+			if i+1 < len(rs) {
+				i++
+			}
+			buf.WriteString(regexp.QuoteMeta(string(rs[i])))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(rs[i])))
+		}
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
+
+// ignoreDir is the ignore files loaded from the directory
+type ignoreDir struct {
+	rules []ignoreRule
+	top   bool
+}
+
+// ignorer decide whether the file is ignored by .gitignore, .goemonignore
+// and the global ignore list.
+type ignorer struct {
+	roots    map[string]bool
+	patterns []string
+	global   []ignoreRule
+	dirs     map[string]*ignoreDir
+	cache    map[string]bool
+}
+
+func newIgnorer(root string, patterns []string) *ignorer {
+	ig := &ignorer{
+		roots:    map[string]bool{},
+		patterns: append([]string{".git"}, patterns...),
+		dirs:     map[string]*ignoreDir{},
+		cache:    map[string]bool{},
+	}
+	ig.addRoot(root)
+	return ig
+}
+
+// addRoot add the watched directory. The global ignore list is applied
+// relative to each of the roots.
+func (ig *ignorer) addRoot(root string) {
+	if ig.roots[root] {
+		return
+	}
+	ig.roots[root] = true
+	ig.global = append(ig.global, parseIgnore(root, ig.patterns)...)
+	ig.cache = map[string]bool{}
+}
+
+// load return the ignore files in dir
+func (ig *ignorer) load(dir string) *ignoreDir {
+	if d, ok := ig.dirs[dir]; ok {
+		return d
+	}
+	d := &ignoreDir{}
+	if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+		d.top = true
+	}
+	for _, name := range ignoreFiles {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		var lines []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		f.Close()
+		d.rules = append(d.rules, parseIgnore(dir, lines)...)
+	}
+	ig.dirs[dir] = d
+	return d
+}
+
+// reset forget the ignore files in dir, when they changed
+func (ig *ignorer) reset(dir string) {
+	delete(ig.dirs, dir)
+	ig.cache = map[string]bool{}
+}
+
+// ignored return true when path or its parent directory is ignored
+func (ig *ignorer) ignored(path string, dir bool) bool {
+	if parent := filepath.Dir(path); parent != path && ig.dirIgnored(parent) {
+		return true
+	}
+	return ig.match(path, dir)
+}
+
+func (ig *ignorer) dirIgnored(dir string) bool {
+	if ig.roots[dir] {
+		return false
+	}
+	if v, ok := ig.cache[dir]; ok {
+		return v
+	}
+	v := false
+	if parent := filepath.Dir(dir); parent != dir {
+		v = ig.dirIgnored(parent) || ig.match(dir, true)
+	}
+	ig.cache[dir] = v
+	return v
+}
+
+func (ig *ignorer) match(path string, dir bool) bool {
+	// the rules in the deeper directory take precedence
+	var chain []*ignoreDir
+	top, root := false, -1
+	for d := filepath.Dir(path); ; d = filepath.Dir(d) {
+		id := ig.load(d)
+		chain = append(chain, id)
+		if root < 0 && ig.roots[d] {
+			root = len(chain) - 1
+		}
+		if id.top {
+			top = true
+			break
+		}
+		if d == filepath.Dir(d) {
+			break
+		}
+	}
+	// without the repository, the ignore files above the root like $HOME
+	// are not applied
+	if !top {
+		if root >= 0 {
+			chain = chain[:root+1]
+		} else {
+			chain = chain[:1]
+		}
+	}
+	ignored := false
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, r := range chain[i].rules {
+			if r.match(path, dir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	for _, r := range ig.global {
+		if r.match(path, dir) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
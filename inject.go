@@ -0,0 +1,113 @@
+package goemon
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// InjectLiveReload return handler which inject the script tag of livereload
+// into text/html responses of h.
+func (g *Goemon) InjectLiveReload(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// partial content can not be rewritten
+		r.Header.Del("Range")
+		iw := &injector{ResponseWriter: w, tag: g.scriptTag(r)}
+		h.ServeHTTP(iw, r)
+		iw.flush()
+	})
+}
+
+// scriptTag return the script tag which load livereload.js from the
+// livereload server.
+func (g *Goemon) scriptTag(r *http.Request) string {
+	host, port, err := net.SplitHostPort(g.liveReloadAddr())
+	if err != nil {
+		return ""
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if host == "" {
+			host = "localhost"
+		}
+	}
+	return `<script src="//` + net.JoinHostPort(host, port) + `/livereload.js"></script>`
+}
+
+func injectScript(b []byte, tag string) []byte {
+	i := bytes.LastIndex(bytes.ToLower(b), []byte("</body>"))
+	if i < 0 {
+		return append(b, tag...)
+	}
+	var buf bytes.Buffer
+	buf.Write(b[:i])
+	buf.WriteString(tag)
+	buf.Write(b[i:])
+	return buf.Bytes()
+}
+
+// injector is http.ResponseWriter which buffer text/html response to inject
+// the script tag.
+type injector struct {
+	http.ResponseWriter
+	tag    string
+	buf    bytes.Buffer
+	status int
+	html   bool
+	wrote  bool
+}
+
+func (w *injector) WriteHeader(code int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	w.status = code
+	ct := w.Header().Get("Content-Type")
+	w.html = w.tag != "" && code == http.StatusOK && strings.HasPrefix(ct, "text/html") && w.Header().Get("Content-Encoding") == ""
+	if w.html {
+		w.Header().Del("Content-Length")
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *injector) Write(b []byte) (int, error) {
+	if !w.wrote {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.html {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *injector) flush() {
+	if !w.html {
+		return
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(injectScript(w.buf.Bytes(), w.tag))
+}
+
+// Flush send the response to the client unless it is buffered
+func (w *injector) Flush() {
+	if w.html {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap return the original http.ResponseWriter for http.ResponseController
+func (w *injector) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -405,6 +405,7 @@ const liveReloadScript = `
     LiveReload.prototype.performReload = function(message) {
       var _ref, _ref1;
       this.log("LiveReload received reload request: " + (JSON.stringify(message, null, 2)));
+      this.hideOverlay();
       return this.reloader.reload(message.path, {
         liveCSS: (_ref = message.liveCSS) != null ? _ref : true,
         liveImg: (_ref1 = message.liveImg) != null ? _ref1 : true,
@@ -415,9 +416,52 @@ const liveReloadScript = `
     };
 
     LiveReload.prototype.performAlert = function(message) {
+      var data;
+      if (message.message.indexOf('goemon:') === 0) {
+        data = JSON.parse(message.message.substring(7));
+        if (data.type === 'error') {
+          return this.showOverlay(data.title, data.output);
+        }
+        return this.hideOverlay();
+      }
       return alert(message.message);
     };
 
+    LiveReload.prototype.showOverlay = function(title, output) {
+      var close, doc, header, overlay, pre;
+      this.hideOverlay();
+      doc = this.window.document;
+      overlay = doc.createElement('div');
+      overlay.id = 'goemon-overlay';
+      overlay.setAttribute('style', 'position:fixed;top:0;left:0;right:0;bottom:0;z-index:2147483647;overflow:auto;margin:0;padding:16px;background:rgba(0,0,0,0.85);color:#e8e8e8;font:13px/1.5 monospace;');
+      header = doc.createElement('div');
+      header.setAttribute('style', 'color:#ff5555;font-weight:bold;margin-bottom:8px;');
+      header.appendChild(doc.createTextNode(title));
+      close = doc.createElement('button');
+      close.setAttribute('style', 'float:right;cursor:pointer;');
+      close.appendChild(doc.createTextNode('\u00d7'));
+      close.onclick = (function(_this) {
+        return function() {
+          return _this.hideOverlay();
+        };
+      })(this);
+      header.appendChild(close);
+      pre = doc.createElement('pre');
+      pre.setAttribute('style', 'margin:0;white-space:pre-wrap;');
+      pre.appendChild(doc.createTextNode(output));
+      overlay.appendChild(header);
+      overlay.appendChild(pre);
+      return doc.body.appendChild(overlay);
+    };
+
+    LiveReload.prototype.hideOverlay = function() {
+      var overlay;
+      overlay = this.window.document.getElementById('goemon-overlay');
+      if (overlay) {
+        return overlay.parentNode.removeChild(overlay);
+      }
+    };
+
     LiveReload.prototype.shutDown = function() {
       var _base;
       if (!this.initialized) {
@@ -0,0 +1,326 @@
+package goemon
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// patterns is the list of the patterns of match and ignore. It can be
+// written as a string or a list of strings in YAML.
+type patterns []string
+
+func (ps *patterns) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*ps = nil
+		if s != "" {
+			*ps = patterns{s}
+		}
+		return nil
+	}
+	var ss []string
+	if err := unmarshal(&ss); err != nil {
+		return err
+	}
+	*ps = ss
+	return nil
+}
+
+func (ps patterns) String() string {
+	return strings.Join(ps, "|")
+}
+
+// compile compile all of the patterns into one wildcard. The relative
+// patterns are resolved against dir.
+func (ps patterns) compile(dir string) (*wildcard, error) {
+	w := &wildcard{src: ps.String()}
+	for _, pattern := range ps {
+		p, err := compilePatternIn(pattern, dir)
+		if err != nil {
+			return nil, err
+		}
+		w.include = append(w.include, p.include...)
+		w.exclude = append(w.exclude, p.exclude...)
+	}
+	if err := w.check(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// wildcard is the compiled pattern of match and ignore. The file matches
+// when it matches any of include, and does not match any of exclude.
+type wildcard struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	src     string
+}
+
+// MatchString return true when s matches the pattern
+func (p *wildcard) MatchString(s string) bool {
+	matched := len(p.include) == 0
+	for _, re := range p.include {
+		if re.MatchString(s) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+	for _, re := range p.exclude {
+		if re.MatchString(s) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *wildcard) String() string {
+	return p.src
+}
+
+// check return error when the wildcard has only negated globs, which would
+// match every file and make goemon watch the whole tree.
+func (p *wildcard) check() error {
+	if len(p.include) == 0 && len(p.exclude) > 0 {
+		return fmt.Errorf("invalid wildcard: %s: only negated globs", p.src)
+	}
+	return nil
+}
+
+// compilePattern compile the wildcard. `%` at the head means the regular
+// expression. Otherwise, the pattern is the list of globs separated by `|`.
+// The glob which starts with `!` excludes the files.
+func compilePattern(pattern string) (*wildcard, error) {
+	p, err := compilePatternIn(pattern, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// compilePatternIn compile the wildcard of which relative globs are resolved
+// against dir. Empty dir means current directory. The wildcard may have only
+// negated globs, since it can be a part of the list.
+func compilePatternIn(pattern, dir string) (*wildcard, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	if pattern[0] == '%' {
+		re, err := regexp.Compile(pattern[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &wildcard{include: []*regexp.Regexp{re}, src: pattern}, nil
+	}
+
+	var includes, excludes []string
+	for _, pat := range splitPattern(pattern, '|') {
+		negate := strings.HasPrefix(pat, "!")
+		if negate {
+			pat = pat[1:]
+		}
+		if pat == "" {
+			return nil, fmt.Errorf("invalid wildcard: %s", pattern)
+		}
+		pat = resolveGlob(pat, dir)
+		s, err := globRegexp([]rune(pat))
+		if err != nil {
+			return nil, fmt.Errorf("invalid wildcard: %s: %v", pattern, err)
+		}
+		if negate {
+			excludes = append(excludes, s)
+		} else {
+			includes = append(includes, s)
+		}
+	}
+
+	p := &wildcard{src: pattern}
+	if len(includes) > 0 {
+		re, err := regexp.Compile("^(?:" + strings.Join(includes, "|") + ")$")
+		if err != nil {
+			return nil, err
+		}
+		p.include = []*regexp.Regexp{re}
+	}
+	if len(excludes) > 0 {
+		re, err := regexp.Compile("^(?:" + strings.Join(excludes, "|") + ")$")
+		if err != nil {
+			return nil, err
+		}
+		p.exclude = []*regexp.Regexp{re}
+	}
+	return p, nil
+}
+
+// resolveGlob make the glob absolute path resolved against dir. Only the
+// literal directories before the first wildcard are cleaned, since cleaning
+// the rest would rewrite the glob like `{a,b/../c}`.
+func resolveGlob(pat, dir string) string {
+	if runtime.GOOS == "windows" {
+		pat = filepath.ToSlash(pat)
+	}
+	base, glob := pat, ""
+	if i := strings.IndexAny(pat, `*?[{\`); i >= 0 {
+		if j := strings.LastIndex(pat[:i], "/"); j >= 0 {
+			base, glob = pat[:j], pat[j+1:]
+		} else {
+			base, glob = "", pat
+		}
+		if base == "" && strings.HasPrefix(pat, "/") {
+			base = "/"
+		}
+	}
+	if base == "" {
+		base = "."
+	}
+	if dir != "" && !filepath.IsAbs(base) {
+		base = filepath.Join(dir, base)
+	}
+	if fs, err := filepath.Abs(base); err == nil {
+		base = filepath.ToSlash(fs)
+	}
+	if glob == "" {
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + glob
+}
+
+// splitPattern split the pattern by sep which is not in braces nor brackets
+func splitPattern(pattern string, sep rune) []string {
+	var ss []string
+	depth, class, start := 0, false, 0
+	rs := []rune(pattern)
+	for i := 0; i < len(rs); i++ {
+		switch {
+		case rs[i] == '\\' && runtime.GOOS != "windows":
+			i++
+		case class:
+			if rs[i] == ']' {
+				class = false
+			}
+		case rs[i] == '[':
+			class = true
+			// `]` at the head of the class is a character
+			if i+1 < len(rs) && (rs[i+1] == '!' || rs[i+1] == '^') {
+				i++
+			}
+			if i+1 < len(rs) && rs[i+1] == ']' {
+				i++
+			}
+		case rs[i] == '{':
+			depth++
+		case rs[i] == '}' && depth > 0:
+			depth--
+		case rs[i] == sep && depth == 0:
+			ss = append(ss, string(rs[start:i]))
+			start = i + 1
+		}
+	}
+	return append(ss, string(rs[start:]))
+}
+
+// globRegexp convert the glob to regular expression
+func globRegexp(rs []rune) (string, error) {
+	// seps is the path separators in the character class
+	sep, seps := `/`, `/`
+	if runtime.GOOS == "windows" {
+		sep, seps = `[/\\]`, `/\\`
+	}
+	notSep := `[^` + seps + `]`
+	var buf strings.Builder
+	for i := 0; i < len(rs); i++ {
+		switch rs[i] {
+		case '/':
+			buf.WriteString(sep)
+		case '*':
+			if i+1 < len(rs) && rs[i+1] == '*' && (i == 0 || rs[i-1] == '/') {
+				if i+2 == len(rs) {
+					// trailing ** matches everything under the directory
+					buf.WriteString(`.*`)
+					i++
+					continue
+				}
+				if rs[i+2] == '/' {
+					// **/ matches zero or more directories
+					buf.WriteString(`(?:.*` + sep + `)?`)
+					i += 2
+					continue
+				}
+			}
+			for i+1 < len(rs) && rs[i+1] == '*' {
+				i++
+			}
+			buf.WriteString(notSep + `+`)
+		case '?':
+			buf.WriteString(notSep)
+		case '[':
+			j := i + 1
+			negate := j < len(rs) && (rs[j] == '!' || rs[j] == '^')
+			if negate {
+				j++
+			}
+			from := j
+			if j < len(rs) && rs[j] == ']' {
+				j++
+			}
+			for j < len(rs) && rs[j] != ']' {
+				j++
+			}
+			if j >= len(rs) {
+				return "", fmt.Errorf("missing ]")
+			}
+			var class strings.Builder
+			for _, r := range rs[from:j] {
+				if r == '\\' || r == '[' || r == ']' || r == '^' {
+					class.WriteRune('\\')
+				}
+				class.WriteRune(r)
+			}
+			if negate {
+				buf.WriteString(`[^` + seps + class.String() + `]`)
+			} else {
+				buf.WriteString(`[` + class.String() + `]`)
+			}
+			i = j
+		case '{':
+			depth, j := 1, i+1
+			for ; j < len(rs) && depth > 0; j++ {
+				switch rs[j] {
+				case '{':
+					depth++
+				case '}':
+					depth--
+				}
+			}
+			if depth > 0 {
+				return "", fmt.Errorf("missing }")
+			}
+			var alts []string
+			for _, alt := range splitPattern(string(rs[i+1:j-1]), ',') {
+				s, err := globRegexp([]rune(alt))
+				if err != nil {
+					return "", err
+				}
+				alts = append(alts, s)
+			}
+			buf.WriteString(`(?:` + strings.Join(alts, "|") + `)`)
+			i = j - 1
+		case '\\':
+			if runtime.GOOS != "windows" && i+1 < len(rs) {
+				i++
+			}
+			buf.WriteString(fmt.Sprintf(`[\x{%x}]`, rs[i]))
+		default:
+			buf.WriteString(fmt.Sprintf(`[\x{%x}]`, rs[i]))
+		}
+	}
+	return buf.String(), nil
+}
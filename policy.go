@@ -0,0 +1,108 @@
+package goemon
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// restartPolicy is how to restart the command which exited by itself
+type restartPolicy struct {
+	RestartPolicy string `yaml:"restart_policy"`
+	Backoff       int    `yaml:"backoff"`
+	BackoffMax    int    `yaml:"backoff_max"`
+	MaxRetries    int    `yaml:"max_retries"`
+}
+
+// respawn return true when the command exited with err should be started
+// again.
+func (rp *restartPolicy) respawn(err error) bool {
+	switch rp.RestartPolicy {
+	case "never":
+		return false
+	case "on-failure":
+		return err != nil
+	}
+	return true
+}
+
+// delay return the time to wait before the retries-th respawn. It doubles
+// for each retry up to backoff_max.
+func (rp *restartPolicy) delay(retries int) time.Duration {
+	d := time.Duration(rp.Backoff) * time.Millisecond
+	if d <= 0 {
+		d = time.Second
+	}
+	max := rp.backoffMax()
+	for i := 1; i < retries && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (rp *restartPolicy) backoffMax() time.Duration {
+	if rp.BackoffMax <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(rp.BackoffMax) * time.Millisecond
+}
+
+// exhausted return true when the command should not be retried anymore
+func (rp *restartPolicy) exhausted(retries int) bool {
+	return rp.MaxRetries > 0 && retries > rp.MaxRetries
+}
+
+// stopPolicy is how to stop the command
+type stopPolicy struct {
+	StopSignal  string `yaml:"stop_signal"`
+	StopTimeout *int   `yaml:"stop_timeout"`
+	StopCommand string `yaml:"stop_command"`
+}
+
+func (sp *stopPolicy) signal() (os.Signal, error) {
+	if sp.StopSignal == "" {
+		return os.Interrupt, nil
+	}
+	return parseSignal(sp.StopSignal)
+}
+
+func (sp *stopPolicy) timeout() time.Duration {
+	if sp.StopTimeout == nil {
+		return 5 * time.Second
+	}
+	return time.Duration(*sp.StopTimeout) * time.Millisecond
+}
+
+// shutdown stop cmd. When sig is nil, cmd is stopped with stop_command or
+// stop_signal, and killed after stop_timeout.
+func (g *Goemon) shutdown(cmd *exec.Cmd, sp *stopPolicy, sig os.Signal) error {
+	if sig == nil && sp.StopCommand != "" {
+		args := shell(sp.StopCommand)
+		sc := exec.Command(args[0], args[1:]...)
+		sc.Env = append(os.Environ(), "GOEMON_PID="+strconv.Itoa(cmd.Process.Pid))
+		sc.Stdout = os.Stdout
+		sc.Stderr = os.Stderr
+		g.Logger.Println("executing", sp.StopCommand)
+		if err := sc.Run(); err != nil {
+			g.Logger.Println(err)
+		} else {
+			if exited(cmd, sp.timeout()) {
+				return nil
+			}
+			return g.stop(cmd, os.Kill, 0)
+		}
+	}
+	if sig == nil {
+		var err error
+		sig, err = sp.signal()
+		if err != nil {
+			g.Logger.Println(err)
+			sig = os.Interrupt
+		}
+	}
+	return g.stop(cmd, sig, sp.timeout())
+}
@@ -3,20 +3,40 @@
 package goemon
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"time"
 )
 
-func (g *Goemon) spawn() error {
-	g.cmd = exec.Command(g.Args[0], g.Args[1:]...)
-	g.cmd.Stdout = os.Stdout
-	g.cmd.Stderr = os.Stderr
+// command return the command to spawn. When socket is configured, the
+// listening socket is passed to the command as fd 3 like systemd socket
+// activation.
+func (g *Goemon) command() (*exec.Cmd, error) {
+	args := g.Args
+	var files []*os.File
+	if g.conf.Socket != "" {
+		f, err := g.socket()
+		if err != nil {
+			return nil, err
+		}
+		files = []*os.File{f}
+		// LISTEN_PID should be the PID of the command. exec keeps the PID.
+		args = append([]string{"sh", "-c", `LISTEN_PID=$$; export LISTEN_PID; exec "$@"`, "goemon"}, args...)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = g.stdout()
+	cmd.Stderr = os.Stderr
+	if files != nil {
+		cmd.ExtraFiles = files
+		cmd.Env = append(os.Environ(), "LISTEN_FDS=1", "LISTEN_FDNAMES=goemon")
+	}
 	// Run the command in its own process group so that terminate can
 	// signal the command and all of its descendants at once.
-	g.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	return g.cmd.Run()
+	setpgid(cmd)
+	return cmd, nil
 }
 
 func signalGroup(p *os.Process, sig os.Signal) error {
@@ -39,28 +59,67 @@ func killGroup(p *os.Process) error {
 	return p.Kill()
 }
 
-func (g *Goemon) terminate(sig os.Signal) error {
-	if sig == nil {
-		sig = os.Interrupt
+func setpgid(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// stop send sig to the process group of cmd, and kill the group when it
+// does not exit within timeout.
+func (g *Goemon) stop(cmd *exec.Cmd, sig os.Signal, timeout time.Duration) error {
+	if sig == os.Kill {
+		return killGroup(cmd.Process)
 	}
-	cmd := g.cmd
-	if cmd != nil && cmd.Process != nil {
-		if sig == os.Kill {
-			return killGroup(cmd.Process)
+	if err := signalGroup(cmd.Process, sig); err != nil {
+		g.Logger.Println(err)
+		return killGroup(cmd.Process)
+	}
+	if exited(cmd, timeout) {
+		return nil
+	}
+	return killGroup(cmd.Process)
+}
+
+// exited wait until the process group of cmd exits within timeout
+func exited(cmd *exec.Cmd, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if syscall.Kill(-cmd.Process.Pid, 0) == syscall.ESRCH {
+			return true
 		}
-		if err := signalGroup(cmd.Process, sig); err != nil {
-			g.Logger.Println(err)
-			return killGroup(cmd.Process)
+		if !time.Now().Before(deadline) {
+			return false
 		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
 
-		deadline := time.Now().Add(5 * time.Second)
-		for time.Now().Before(deadline) {
-			if syscall.Kill(-cmd.Process.Pid, 0) == syscall.ESRCH {
-				return nil
-			}
-			time.Sleep(100 * time.Millisecond)
-		}
-		return killGroup(cmd.Process)
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+}
+
+func parseSignal(name string) (os.Signal, error) {
+	s, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return nil, fmt.Errorf("unknown signal %v", name)
+	}
+	if s == syscall.SIGKILL {
+		return os.Kill, nil
+	}
+	return s, nil
+}
+
+// terminate stop the command. When sig is nil, the stop policy in the
+// configuration is used.
+func (g *Goemon) terminate(sig os.Signal) error {
+	cmd := g.running()
+	if cmd != nil {
+		return g.shutdown(cmd, &g.conf.stopPolicy, sig)
 	}
 	return nil
 }
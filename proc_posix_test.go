@@ -4,13 +4,18 @@ package goemon
 
 import (
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/fswatcher/fswatcher"
 )
 
 func TestTerminateProcessGroup(t *testing.T) {
@@ -57,3 +62,527 @@ func TestTerminateProcessGroup(t *testing.T) {
 	syscall.Kill(pid, syscall.SIGKILL)
 	t.Fatal("grandchild process should be terminated")
 }
+
+func TestOnBusyRestart(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	marker := filepath.Join(dir, "marker")
+	conf := filepath.Join(dir, "goemon.yml")
+	ioutil.WriteFile(conf, []byte(`
+tasks:
+- match: './assets/*.js'
+  on_busy: restart
+  commands:
+  - echo ${GOEMON_TARGET_FILES} >> `+out+`; [ -f `+marker+` ] || sleep 30
+`), 0644)
+
+	g := New()
+	g.File = conf
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+
+	lines := func(n int) []string {
+		for i := 0; i < 50; i++ {
+			b, _ := ioutil.ReadFile(out)
+			if ss := strings.Split(strings.TrimSpace(string(b)), "\n"); len(b) > 0 && len(ss) >= n {
+				return ss
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("command should be run %d times", n)
+		return nil
+	}
+
+	a, _ := filepath.Abs("assets/a.js")
+	b, _ := filepath.Abs("assets/b.js")
+	g.task(fswatcher.Event{Name: a, Op: fswatcher.Write})
+	lines(1)
+
+	ioutil.WriteFile(marker, nil, 0644)
+	g.task(fswatcher.Event{Name: b, Op: fswatcher.Write})
+	ss := lines(2)
+	if !strings.Contains(ss[1], "a.js") || !strings.Contains(ss[1], "b.js") {
+		t.Fatalf("Should restart with merged files: %v", ss[1])
+	}
+
+	for i := 0; i < 50 && atomic.LoadUint64(&g.tasks) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if atomic.LoadUint64(&g.tasks) > 0 {
+		t.Fatal("task should be finished")
+	}
+}
+
+func TestOnBusyRestartForeach(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	marker := filepath.Join(dir, "marker")
+	conf := filepath.Join(dir, "goemon.yml")
+	ioutil.WriteFile(conf, []byte(`
+tasks:
+- match: './assets/*.js'
+  on_busy: restart
+  commands:
+  - ":foreach echo ${GOEMON_TARGET_FILE} >> `+out+`; [ -f `+marker+` ] || sleep 30"
+`), 0644)
+
+	g := New()
+	g.File = conf
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+
+	a, _ := filepath.Abs("assets/a.js")
+	b, _ := filepath.Abs("assets/b.js")
+	g.task(fswatcher.Event{Name: a, Op: fswatcher.Write})
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(out); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the sub-command of :foreach should be killed by the new change
+	ioutil.WriteFile(marker, nil, 0644)
+	g.task(fswatcher.Event{Name: b, Op: fswatcher.Write})
+	for i := 0; i < 50 && atomic.LoadUint64(&g.tasks) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if atomic.LoadUint64(&g.tasks) > 0 {
+		t.Fatal("task should be finished")
+	}
+	bs, _ := ioutil.ReadFile(out)
+	if ss := strings.Fields(string(bs)); len(ss) != 3 || ss[0] != a {
+		t.Fatalf("Should restart with merged files: %v", ss)
+	}
+}
+
+func TestProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pidfile := filepath.Join(dir, "pid")
+	conf := filepath.Join(dir, "goemon.yml")
+	ioutil.WriteFile(conf, []byte(`
+processes:
+  api:
+    command: echo $$ > pid; exec sleep 30
+    dir: `+dir+`
+`), 0644)
+
+	g := New()
+	g.File = conf
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+	g.startProcesses()
+	defer g.stopProcesses()
+
+	readPid := func(old int) int {
+		for i := 0; i < 50; i++ {
+			if b, err := ioutil.ReadFile(pidfile); err == nil {
+				if pid, _ := strconv.Atoi(strings.TrimSpace(string(b))); pid != 0 && pid != old {
+					return pid
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatal("process should be started")
+		return 0
+	}
+	waitState := func(state string) {
+		for i := 0; i < 50; i++ {
+			if ps := g.processStatuses(); len(ps) == 1 && ps[0].State == state {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("process should be %v", state)
+	}
+
+	pid := readPid(0)
+	if !g.internalCommand(":restart api", &job{}) {
+		t.Fatal("Should be succeeded")
+	}
+	if readPid(pid) == pid {
+		t.Fatal("process should be restarted")
+	}
+	if g.internalCommand(":restart web", &job{}) {
+		t.Fatal("Should not be succeeded for unknown process")
+	}
+
+	if !g.internalCommand(":stop api", &job{}) {
+		t.Fatal("Should be succeeded")
+	}
+	waitState("stopped")
+	os.Remove(pidfile)
+	if !g.internalCommand(":start api", &job{}) {
+		t.Fatal("Should be succeeded")
+	}
+	readPid(0)
+	waitState("running")
+}
+
+func TestProcessDependencies(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	conf := filepath.Join(dir, "goemon.yml")
+	ioutil.WriteFile(conf, []byte(`
+processes:
+  worker:
+    command: echo worker >> out; exec sleep 30
+    dir: `+dir+`
+    depends_on: [api]
+  api:
+    command: sleep 0.2; echo api >> out; echo listening; exec sleep 30
+    dir: `+dir+`
+    depends_on: [migrate]
+    cascade: true
+    ready:
+      log: listening
+  migrate:
+    command: sleep 0.2; echo migrate >> out
+    dir: `+dir+`
+    oneshot: true
+`), 0644)
+
+	g := New()
+	g.File = conf
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+	g.startProcesses()
+	defer g.stopProcesses()
+
+	wait := func(expected string) {
+		var b []byte
+		for i := 0; i < 50; i++ {
+			b, _ = ioutil.ReadFile(out)
+			if string(b) == expected {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("Should be %q but %q", expected, string(b))
+	}
+
+	wait("migrate\napi\nworker\n")
+	if !g.internalCommand(":restart api", &job{}) {
+		t.Fatal("Should be succeeded")
+	}
+	wait("migrate\napi\nworker\napi\nworker\n")
+}
+
+func TestProcessDependencyFailure(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "goemon.yml")
+	ioutil.WriteFile(conf, []byte(`
+processes:
+  worker:
+    command: exec sleep 30
+    depends_on: [api]
+  api:
+    command: exec sleep 30
+    depends_on: [migrate]
+  migrate:
+    command: exit 1
+    oneshot: true
+`), 0644)
+
+	g := New()
+	g.File = conf
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+	g.startProcesses()
+	defer g.stopProcesses()
+
+	var ps []*processStatus
+	for i := 0; i < 50; i++ {
+		ps = g.processStatuses()
+		if ps[0].State == "failed" && ps[1].State == "failed" && ps[2].State == "failed" {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, st := range ps {
+		t.Errorf("%v should be failed but %v", st.Name, st.State)
+	}
+}
+
+func TestProcessCircularDependency(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "goemon.yml")
+	ioutil.WriteFile(conf, []byte(`
+processes:
+  api:
+    command: exec sleep 30
+    depends_on: [worker]
+  worker:
+    command: exec sleep 30
+    depends_on: [api]
+    cascade: true
+`), 0644)
+
+	g := New()
+	g.File = conf
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+	g.startProcesses()
+	defer g.stopProcesses()
+	if len(g.procs) != 0 {
+		t.Fatal("Should not supervise processes with circular dependency")
+	}
+	if g.internalCommand(":restart api", &job{}) {
+		t.Fatal("Should not be succeeded for unknown process")
+	}
+}
+
+func TestProcessCrash(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	conf := filepath.Join(dir, "goemon.yml")
+	ioutil.WriteFile(conf, []byte(`
+processes:
+  api:
+    command: echo crash >> out; exit 1
+    dir: `+dir+`
+    backoff: 10
+    max_retries: 2
+`), 0644)
+
+	g := New()
+	g.File = conf
+	err = g.load()
+	if err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+	g.startProcesses()
+	defer g.stopProcesses()
+
+	for i := 0; i < 50; i++ {
+		if ps := g.processStatuses(); ps[0].State == "crashed" {
+			b, _ := ioutil.ReadFile(out)
+			if n := strings.Count(string(b), "crash"); n != 3 {
+				t.Fatalf("Should retry max_retries times: %v", n)
+			}
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("process should be crashed")
+}
+
+func TestStopPolicy(t *testing.T) {
+	zero, grace := 0, 500
+	tests := []struct {
+		name    string
+		policy  stopPolicy
+		script  string
+		output  string
+		minTime time.Duration
+		maxTime time.Duration
+	}{
+		{
+			name:    "stop_signal",
+			policy:  stopPolicy{StopSignal: "SIGTERM"},
+			script:  `trap 'echo term > out; exit 0' TERM; echo $$ > pid`,
+			output:  "term\n",
+			maxTime: 3 * time.Second,
+		},
+		{
+			name:    "stop_timeout immediately",
+			policy:  stopPolicy{StopTimeout: &zero},
+			script:  `trap '' INT; echo $$ > pid`,
+			maxTime: 300 * time.Millisecond,
+		},
+		{
+			name:    "stop_timeout grace",
+			policy:  stopPolicy{StopTimeout: &grace},
+			script:  `trap '' INT; echo $$ > pid`,
+			minTime: 500 * time.Millisecond,
+			maxTime: 3 * time.Second,
+		},
+		{
+			name:    "stop_command",
+			policy:  stopPolicy{StopCommand: `echo $GOEMON_PID > stop`, StopTimeout: &grace},
+			script:  `trap '' INT; echo $$ > pid; while [ ! -f stop ]; do sleep 0.1; done; echo stopped > out; exit 0`,
+			output:  "stopped\n",
+			maxTime: 400 * time.Millisecond,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			g := New()
+			g.conf.stopPolicy = test.policy
+			if test.policy.StopCommand != "" {
+				g.conf.StopCommand = "cd " + quote(dir) + "; " + test.policy.StopCommand
+			}
+			g.Args = []string{"sh", "-c", "cd " + quote(dir) + "; " + test.script + `; while :; do sleep 0.1; done`}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- g.spawn()
+			}()
+			for i := 0; i < 50; i++ {
+				if b, err := ioutil.ReadFile(filepath.Join(dir, "pid")); err == nil && len(b) > 0 {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			start := time.Now()
+			err := g.terminate(nil)
+			elapsed := time.Since(start)
+			<-done
+			if err != nil {
+				t.Fatalf("Should be succeeded: %v", err)
+			}
+			if elapsed < test.minTime || elapsed > test.maxTime {
+				t.Fatalf("Should be stopped in %v-%v but %v", test.minTime, test.maxTime, elapsed)
+			}
+			if test.output != "" {
+				b, _ := ioutil.ReadFile(filepath.Join(dir, "out"))
+				if string(b) != test.output {
+					t.Fatalf("Should output %q but %q", test.output, string(b))
+				}
+			}
+		})
+	}
+
+	t.Run("stop_command after exit", func(t *testing.T) {
+		dir := t.TempDir()
+		g := New()
+		g.conf.StopCommand = "cd " + quote(dir) + "; echo $GOEMON_PID >> stop"
+		g.Args = []string{"sh", "-c", "exit 1"}
+		for i := 0; i < 3; i++ {
+			g.restart()
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "stop")); err == nil {
+			t.Fatalf("Should not stop the command which exited: %q", string(b))
+		}
+	})
+}
+
+func TestHandoffHelper(t *testing.T) {
+	if os.Getenv("GOEMON_HANDOFF_HELPER") != "1" {
+		return
+	}
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) || os.Getenv("LISTEN_FDS") != "1" {
+		os.Exit(2)
+	}
+	l, err := net.FileListener(os.NewFile(3, "goemon"))
+	if err != nil {
+		os.Exit(2)
+	}
+	os.Stdout.WriteString("ready\n")
+	http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(os.Getpid())))
+	}))
+}
+
+func TestHandoff(t *testing.T) {
+	g := New()
+	g.conf.Socket = "127.0.0.1:0"
+	g.conf.Ready.Log = "^ready"
+	if err := g.conf.Ready.compile(); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GOEMON_HANDOFF_HELPER", "1")
+	defer os.Unsetenv("GOEMON_HANDOFF_HELPER")
+	g.Args = []string{os.Args[0], "-test.run=^TestHandoffHelper$"}
+
+	f, err := g.socket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + l.Addr().String()
+	l.Close()
+
+	get := func() string {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal("Should be served", err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- g.spawn()
+	}()
+	if err := g.waitReady(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	old := get()
+
+	if err := g.handoff(os.Interrupt); err != nil {
+		t.Fatal("Should be succeeded", err)
+	}
+	<-done
+	next := g.next.cmd.Process.Pid
+	go func() {
+		done <- g.restart()
+	}()
+	defer func() {
+		syscall.Kill(-next, syscall.SIGKILL)
+		<-done
+	}()
+
+	pid := get()
+	if pid == old {
+		t.Fatal("Should be served by new command")
+	}
+	if pid != strconv.Itoa(next) {
+		t.Fatalf("Should be served by %v but %v", next, pid)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -16,37 +17,69 @@ var (
 	procGenerateConsoleCtrlEvent = libkernel32.MustFindProc("GenerateConsoleCtrlEvent")
 )
 
-func (g *Goemon) spawn() error {
-	g.cmd = exec.Command(g.Args[0], g.Args[1:]...)
-	g.cmd.Stdout = os.Stdout
-	g.cmd.Stderr = os.Stderr
-	g.cmd.SysProcAttr = &syscall.SysProcAttr{
-		CreationFlags: syscall.CREATE_UNICODE_ENVIRONMENT | 0x00000200,
-	}
-	return g.cmd.Run()
+// command return the command to spawn. The socket can not be passed on
+// Windows.
+func (g *Goemon) command() (*exec.Cmd, error) {
+	cmd := exec.Command(g.Args[0], g.Args[1:]...)
+	cmd.Stdout = g.stdout()
+	cmd.Stderr = os.Stderr
+	setpgid(cmd)
+	return cmd, nil
 }
 
 func kill(p *os.Process) error {
 	return exec.Command("taskkill", "/F", "/T", "/PID", fmt.Sprint(p.Pid)).Run()
 }
 
-func (g *Goemon) terminate(sig os.Signal) error {
-	cmd := g.cmd
-	if cmd != nil && cmd.Process != nil {
-		if err := interrupt(cmd.Process, sig); err != nil {
-			g.Logger.Println(err)
-			return kill(cmd.Process)
-		}
+func setpgid(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_UNICODE_ENVIRONMENT | 0x00000200,
+	}
+}
 
-		deadline := time.Now().Add(5 * time.Second)
-		for time.Now().Before(deadline) {
-			if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
-				return nil
-			}
-			time.Sleep(100 * time.Millisecond)
-		}
+// stop interrupt cmd, and kill the process tree when it does not exit
+// within timeout.
+func (g *Goemon) stop(cmd *exec.Cmd, sig os.Signal, timeout time.Duration) error {
+	if err := interrupt(cmd.Process, sig); err != nil {
+		g.Logger.Println(err)
 		return kill(cmd.Process)
 	}
+	if exited(cmd, timeout) {
+		return nil
+	}
+	return kill(cmd.Process)
+}
+
+// exited wait until cmd exits within timeout. The process is waited with its
+// handle, since ProcessState is written by the goroutine waiting for cmd.
+func exited(cmd *exec.Cmd, timeout time.Duration) bool {
+	h, err := syscall.OpenProcess(syscall.SYNCHRONIZE, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		// the process is already gone
+		return true
+	}
+	defer syscall.CloseHandle(h)
+	ev, err := syscall.WaitForSingleObject(h, uint32(timeout/time.Millisecond))
+	return err == nil && ev == syscall.WAIT_OBJECT_0
+}
+
+func parseSignal(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "INT":
+		return os.Interrupt, nil
+	case "KILL":
+		return os.Kill, nil
+	}
+	return nil, fmt.Errorf("unsupported signal %v", name)
+}
+
+// terminate stop the command. When sig is nil, the stop policy in the
+// configuration is used.
+func (g *Goemon) terminate(sig os.Signal) error {
+	cmd := g.running()
+	if cmd != nil {
+		return g.shutdown(cmd, &g.conf.stopPolicy, sig)
+	}
 	return nil
 }
 
@@ -0,0 +1,481 @@
+package goemon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// process is a long-running command supervised by goemon
+type process struct {
+	Command   string            `yaml:"command"`
+	Env       map[string]string `yaml:"env"`
+	Dir       string            `yaml:"dir"`
+	DependsOn []string          `yaml:"depends_on"`
+	Ready     probe             `yaml:"ready"`
+	Oneshot   bool              `yaml:"oneshot"`
+	Cascade   bool              `yaml:"cascade"`
+
+	restartPolicy `yaml:",inline"`
+	stopPolicy    `yaml:",inline"`
+
+	name    string
+	cmd     *exec.Cmd
+	state   string
+	stopped bool
+	restart bool
+	retries int
+	ready   chan struct{}
+	down    chan struct{}
+	wake    chan struct{}
+	mutex   sync.Mutex
+}
+
+// processStatus is the state of the process served by the status API
+type processStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Ready bool   `json:"ready"`
+	Pid   int    `json:"pid,omitempty"`
+}
+
+// prefixWriter write each line to w with prefix
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(b []byte) (int, error) {
+	pw.buf = append(pw.buf, b...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := append([]byte(pw.prefix), pw.buf[:i+1]...)
+		pw.buf = pw.buf[i+1:]
+		if _, err := pw.w.Write(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (pw *prefixWriter) flush() {
+	if len(pw.buf) > 0 {
+		pw.w.Write(append([]byte(pw.prefix), append(pw.buf, '\n')...))
+		pw.buf = nil
+	}
+}
+
+// readyChan return the channel which is closed when the process get ready.
+// For oneshot process, it is closed when the process exited successfully.
+func (p *process) readyChan(renew bool) chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.ready == nil || renew {
+		p.ready = make(chan struct{})
+	}
+	return p.ready
+}
+
+// downChan return the channel which is closed when the process could not get
+// ready. The channel is renewed when the process is started again.
+func (p *process) downChan() chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.down == nil {
+		p.down = make(chan struct{})
+	}
+	return p.down
+}
+
+// fail notify the dependents that the process could not get ready. It
+// should be called with the lock.
+func (p *process) fail() {
+	if p.down == nil {
+		p.down = make(chan struct{})
+	}
+	if !isClosed(p.down) {
+		close(p.down)
+	}
+}
+
+func (p *process) setState(state string) {
+	p.mutex.Lock()
+	p.state = state
+	p.mutex.Unlock()
+}
+
+// sortProcesses return names of processes in the order to be started. The
+// processes depending on others come after them.
+func sortProcesses(procs map[string]*process) ([]string, error) {
+	var names []string
+	for name := range procs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sorted []string
+	visited := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch visited[name] {
+		case 1:
+			return fmt.Errorf("circular dependency: %v", strings.Join(append(path, name), " -> "))
+		case 2:
+			return nil
+		}
+		p, ok := procs[name]
+		if !ok {
+			return fmt.Errorf("unknown process %v in depends_on of %v", name, path[len(path)-1])
+		}
+		visited[name] = 1
+		for _, dep := range p.DependsOn {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		visited[name] = 2
+		sorted = append(sorted, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+func (g *Goemon) startProcesses() {
+	// none of the processes are started when the dependencies are broken
+	names, err := sortProcesses(g.conf.Processes)
+	if err != nil {
+		g.Logger.Println(err)
+		return
+	}
+	procs := map[string]*process{}
+	for name, p := range g.conf.Processes {
+		p.name = name
+		p.wake = make(chan struct{}, 1)
+		p.readyChan(true)
+		procs[name] = p
+	}
+	g.procs = procs
+	for _, name := range names {
+		go g.supervise(g.procs[name])
+	}
+}
+
+// waitDependencies wait until all of the dependencies of the process get
+// ready. It return error when any of them could not get ready.
+func (g *Goemon) waitDependencies(p *process) error {
+	for _, name := range p.DependsOn {
+		dep := g.procs[name]
+		ready, down := dep.readyChan(false), dep.downChan()
+		select {
+		case <-ready:
+			continue
+		default:
+		}
+		if !isClosed(down) {
+			g.Logger.Printf("process %s is waiting for %s", p.name, name)
+			p.setState("waiting")
+		}
+		select {
+		case <-ready:
+		case <-down:
+			return fmt.Errorf("%s is not ready", name)
+		}
+	}
+	return nil
+}
+
+func (g *Goemon) supervise(p *process) {
+	for {
+		p.mutex.Lock()
+		stopped := p.stopped
+		p.mutex.Unlock()
+		if stopped {
+			<-p.wake
+			continue
+		}
+
+		if err := g.waitDependencies(p); err != nil {
+			g.Logger.Printf("process %s is not started, waiting for :start or :restart: %v", p.name, err)
+			p.mutex.Lock()
+			p.stopped = true
+			p.state = "failed"
+			// the dependents of p can not be started too
+			p.fail()
+			p.mutex.Unlock()
+			continue
+		}
+		g.Logger.Println("starting process", p.name)
+		started := time.Now()
+		err := g.spawnProcess(p)
+		if err != nil {
+			g.Logger.Printf("process %s exited: %v", p.name, err)
+		} else {
+			g.Logger.Printf("process %s exited", p.name)
+		}
+
+		p.mutex.Lock()
+		restart := p.restart
+		p.restart = false
+		if restart || p.stopped || time.Since(started) > p.backoffMax() {
+			p.retries = 0
+		}
+		state := "restarting"
+		if p.stopped {
+			state = "stopped"
+		} else if !restart {
+			switch {
+			case p.Oneshot:
+				p.stopped = true
+				state = "failed"
+				if err != nil {
+					p.fail()
+				} else {
+					state = "completed"
+					if !isClosed(p.ready) {
+						close(p.ready)
+					}
+				}
+			case !p.respawn(err):
+				p.stopped = true
+				state = "exited"
+			default:
+				p.retries++
+				if p.exhausted(p.retries) {
+					g.Logger.Printf("process %s crashed %d times, waiting for :start or :restart", p.name, p.retries)
+					p.fail()
+					p.stopped = true
+					p.retries = 0
+					state = "crashed"
+				} else {
+					state = "backoff"
+				}
+			}
+		}
+		p.state = state
+		retries := p.retries
+		p.mutex.Unlock()
+
+		if state == "backoff" {
+			d := p.delay(retries)
+			g.Logger.Printf("restarting process %s in %v", p.name, d)
+			select {
+			case <-time.After(d):
+			case <-p.wake:
+			}
+		}
+	}
+}
+
+func (g *Goemon) spawnProcess(p *process) error {
+	args := shell(p.Command)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = p.Dir
+	cmd.Env = os.Environ()
+	for k, v := range p.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	stdout := &prefixWriter{w: os.Stdout, prefix: "[" + p.name + "] "}
+	stderr := &prefixWriter{w: os.Stderr, prefix: "[" + p.name + "] "}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	logged := make(chan struct{})
+	if p.Ready.lre != nil {
+		cmd.Stdout = &logWriter{w: stdout, re: p.Ready.lre, ready: logged}
+	}
+	setpgid(cmd)
+
+	p.mutex.Lock()
+	err := cmd.Start()
+	if err == nil {
+		p.cmd = cmd
+		p.state = "running"
+		if p.ready == nil || isClosed(p.ready) {
+			p.ready = make(chan struct{})
+		}
+		if p.down == nil || isClosed(p.down) {
+			p.down = make(chan struct{})
+		}
+	}
+	ready, down := p.ready, p.down
+	p.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if !p.Oneshot {
+		go func() {
+			if p.Ready.configured() {
+				if err := p.Ready.wait(p.Ready.timeout(), logged); err != nil {
+					g.Logger.Printf("process %s is not ready: %v", p.name, err)
+					p.mutex.Lock()
+					if p.down == down {
+						p.fail()
+					}
+					p.mutex.Unlock()
+					return
+				}
+				g.Logger.Printf("process %s is ready", p.name)
+			}
+			p.mutex.Lock()
+			if !isClosed(ready) {
+				close(ready)
+			}
+			p.mutex.Unlock()
+		}()
+	}
+	err = cmd.Wait()
+	stdout.flush()
+	stderr.flush()
+	p.mutex.Lock()
+	p.cmd = nil
+	p.mutex.Unlock()
+	return err
+}
+
+// terminateProcess stop the process. The process is started again when
+// restart is true.
+func (g *Goemon) terminateProcess(p *process, sig os.Signal, restart bool) error {
+	p.mutex.Lock()
+	cmd := p.cmd
+	if restart {
+		p.restart = cmd != nil
+		p.stopped = false
+		// dependents should wait for the new process
+		if isClosed(p.ready) {
+			p.ready = make(chan struct{})
+		}
+		if p.down != nil && isClosed(p.down) {
+			p.down = make(chan struct{})
+		}
+	} else {
+		p.stopped = true
+	}
+	p.mutex.Unlock()
+	if restart && p.Cascade {
+		for _, d := range g.dependents(p) {
+			g.Logger.Println("restarting dependent process", d.name)
+			if err := g.terminateProcess(d, sig, true); err != nil {
+				g.Logger.Println(err)
+			}
+		}
+	}
+	if restart && cmd == nil {
+		g.startProcess(p)
+		return nil
+	}
+	if cmd == nil {
+		return nil
+	}
+	return g.shutdown(cmd, &p.stopPolicy, sig)
+}
+
+// dependents return processes which depend on p
+func (g *Goemon) dependents(p *process) []*process {
+	var ds []*process
+	for _, d := range g.procs {
+		for _, name := range d.DependsOn {
+			if name == p.name {
+				ds = append(ds, d)
+				break
+			}
+		}
+	}
+	return ds
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *Goemon) startProcess(p *process) {
+	p.mutex.Lock()
+	p.stopped = false
+	p.mutex.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (g *Goemon) stopProcesses() {
+	var wg sync.WaitGroup
+	for _, p := range g.procs {
+		wg.Add(1)
+		go func(p *process) {
+			defer wg.Done()
+			if err := g.terminateProcess(p, nil, false); err != nil {
+				g.Logger.Println(err)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
+
+// processCommand run :restart, :stop or :start for the named processes
+func (g *Goemon) processCommand(command string, sig os.Signal, names []string) bool {
+	for _, name := range names {
+		p, ok := g.procs[name]
+		if !ok {
+			g.Logger.Printf("unknown process %v for %v command", name, command)
+			return false
+		}
+		g.Logger.Println(command, name)
+		switch command {
+		case ":start":
+			g.startProcess(p)
+		case ":stop":
+			if err := g.terminateProcess(p, sig, false); err != nil {
+				g.Logger.Println(err)
+				return false
+			}
+		default:
+			if err := g.terminateProcess(p, sig, true); err != nil {
+				g.Logger.Println(err)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (g *Goemon) processStatuses() []*processStatus {
+	var names []string
+	for name := range g.procs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ps := []*processStatus{}
+	for _, name := range names {
+		p := g.procs[name]
+		p.mutex.Lock()
+		st := &processStatus{Name: name, State: p.state, Ready: isClosed(p.ready)}
+		if st.State == "" {
+			st.State = "stopped"
+		}
+		if p.cmd != nil && p.cmd.Process != nil {
+			st.Pid = p.cmd.Process.Pid
+		}
+		p.mutex.Unlock()
+		ps = append(ps, st)
+	}
+	return ps
+}
@@ -0,0 +1,95 @@
+package goemon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type proxy struct {
+	Listen   string `yaml:"listen"`
+	Upstream string `yaml:"upstream"`
+	Timeout  int    `yaml:"timeout"`
+}
+
+func (g *Goemon) upstream() (*url.URL, error) {
+	upstream := g.conf.Proxy.Upstream
+	if upstream == "" {
+		return nil, errors.New("upstream of proxy is not specified")
+	}
+	if !strings.Contains(upstream, "://") {
+		upstream = "http://" + upstream
+	}
+	return url.Parse(upstream)
+}
+
+// dialUpstream connect to the upstream. When the connection is refused, the
+// app may be restarting, so it retries until the timeout.
+func (g *Goemon) dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err == nil {
+		return conn, nil
+	}
+	timeout := time.Duration(g.conf.Proxy.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+		conn, err = d.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (g *Goemon) proxyHandler() (http.Handler, error) {
+	u, err := g.upstream()
+	if err != nil {
+		return nil, err
+	}
+	rp := httputil.NewSingleHostReverseProxy(u)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = g.dialUpstream
+	rp.Transport = transport
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		g.Logger.Println(err)
+		var oe *net.OpError
+		if errors.As(err, &oe) && oe.Op == "dial" {
+			http.Error(w, "upstream is not ready: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+	h := g.InjectLiveReload(rp)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the response should not be compressed to inject the script
+		r.Header.Del("Accept-Encoding")
+		h.ServeHTTP(w, r)
+	}), nil
+}
+
+func (g *Goemon) proxy() error {
+	h, err := g.proxyHandler()
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", g.conf.Proxy.Listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return http.Serve(l, h)
+}
@@ -0,0 +1,162 @@
+package goemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// probe is the readiness check of the app
+type probe struct {
+	TCP     string `yaml:"tcp"`
+	HTTP    string `yaml:"http"`
+	Log     string `yaml:"log"`
+	Timeout int    `yaml:"timeout"`
+	lre     *regexp.Regexp
+}
+
+func (p *probe) configured() bool {
+	return p.TCP != "" || p.HTTP != "" || p.lre != nil
+}
+
+func (p *probe) compile() error {
+	p.lre = nil
+	if p.Log == "" {
+		return nil
+	}
+	var err error
+	p.lre, err = regexp.Compile(p.Log)
+	return err
+}
+
+func (p *probe) timeout() time.Duration {
+	if p.Timeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(p.Timeout) * time.Millisecond
+}
+
+// logWriter write to w, and close ready when a line matches re
+type logWriter struct {
+	w     io.Writer
+	re    *regexp.Regexp
+	ready chan struct{}
+	buf   []byte
+	once  sync.Once
+}
+
+func (lw *logWriter) Write(b []byte) (int, error) {
+	n, err := lw.w.Write(b)
+	select {
+	case <-lw.ready:
+		return n, err
+	default:
+	}
+	lw.buf = append(lw.buf, b...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := lw.buf[:i]
+		lw.buf = lw.buf[i+1:]
+		if lw.re.Match(line) {
+			lw.once.Do(func() { close(lw.ready) })
+			lw.buf = nil
+			break
+		}
+	}
+	if len(lw.buf) > maxOutput {
+		lw.buf = lw.buf[len(lw.buf)-maxOutput:]
+	}
+	return n, err
+}
+
+// readyChan return the channel which is closed when the app printed the
+// line of the log probe.
+func (g *Goemon) readyChan(renew bool) chan struct{} {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.ready == nil || renew {
+		g.ready = make(chan struct{})
+	}
+	return g.ready
+}
+
+// stdout return the writer for stdout of the app
+func (g *Goemon) stdout() io.Writer {
+	if g.conf.Ready.lre == nil {
+		return os.Stdout
+	}
+	return &logWriter{w: os.Stdout, re: g.conf.Ready.lre, ready: g.readyChan(false)}
+}
+
+// waitReady wait until the app get ready in timeout
+func (g *Goemon) waitReady(timeout time.Duration) error {
+	if !g.conf.Ready.configured() {
+		return nil
+	}
+	return g.conf.Ready.wait(timeout, g.readyChan(false))
+}
+
+// wait run the probe until it succeeds in timeout. logged is closed when
+// the line of the log probe was printed.
+func (p *probe) wait(timeout time.Duration, logged <-chan struct{}) error {
+	deadline := time.Now().Add(timeout)
+	if p.lre != nil {
+		select {
+		case <-logged:
+		case <-time.After(time.Until(deadline)):
+			return fmt.Errorf("timeout waiting for log %q", p.Log)
+		}
+	}
+	if p.TCP != "" {
+		if err := poll(deadline, func() error {
+			conn, err := net.DialTimeout("tcp", p.TCP, time.Second)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}); err != nil {
+			return fmt.Errorf("timeout waiting for %v: %v", p.TCP, err)
+		}
+	}
+	if p.HTTP != "" {
+		client := &http.Client{Timeout: time.Second}
+		if err := poll(deadline, func() error {
+			resp, err := client.Get(p.HTTP)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return errors.New(resp.Status)
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("timeout waiting for %v: %v", p.HTTP, err)
+		}
+	}
+	return nil
+}
+
+// poll call f until it succeeds or deadline is exceeded
+func poll(deadline time.Time, f func() error) error {
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
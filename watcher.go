@@ -0,0 +1,236 @@
+package goemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fswatcher/fswatcher"
+)
+
+// watcher is the backend to watch files
+type watcher interface {
+	Add(path string, op fswatcher.Op) error
+	Remove(path string) error
+	Close() error
+	Events() <-chan fswatcher.Event
+	Errors() <-chan error
+}
+
+// notifyWatcher is the watcher using the notification of OS
+type notifyWatcher struct {
+	w *fswatcher.Watcher
+}
+
+func (nw *notifyWatcher) Add(path string, op fswatcher.Op) error { return nw.w.Add(path, op) }
+func (nw *notifyWatcher) Remove(path string) error               { return nw.w.Remove(path) }
+func (nw *notifyWatcher) Close() error                           { return nw.w.Close() }
+func (nw *notifyWatcher) Events() <-chan fswatcher.Event         { return nw.w.Events }
+func (nw *notifyWatcher) Errors() <-chan error                   { return nw.w.Errors }
+
+// newWatcher create the watcher which is selected by name
+func newWatcher(name string, interval time.Duration) (watcher, error) {
+	switch name {
+	case "", "notify":
+		w, err := fswatcher.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		return &notifyWatcher{w: w}, nil
+	case "poll":
+		return newPollWatcher(interval), nil
+	}
+	return nil, fmt.Errorf("unknown watcher %v", name)
+}
+
+// fileState is the state of the file seen by pollWatcher
+type fileState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+	hash    string
+}
+
+// pollWatcher watch files by polling for the file systems which do not
+// notify changes, like network file systems or bind mounts of containers.
+type pollWatcher struct {
+	interval time.Duration
+	paths    map[string]fswatcher.Op
+	files    map[string]*fileState
+	events   chan fswatcher.Event
+	errors   chan error
+	done     chan struct{}
+	once     sync.Once
+	mutex    sync.Mutex
+}
+
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	pw := &pollWatcher{
+		interval: interval,
+		paths:    map[string]fswatcher.Op{},
+		files:    map[string]*fileState{},
+		events:   make(chan fswatcher.Event, 100),
+		errors:   make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go pw.loop()
+	return pw
+}
+
+func (pw *pollWatcher) Events() <-chan fswatcher.Event { return pw.events }
+func (pw *pollWatcher) Errors() <-chan error           { return pw.errors }
+
+func (pw *pollWatcher) Add(path string, op fswatcher.Op) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	pw.paths[path] = op
+	for name, st := range pw.scan(path) {
+		if _, ok := pw.files[name]; !ok {
+			pw.files[name] = st
+		}
+	}
+	return nil
+}
+
+func (pw *pollWatcher) Remove(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	delete(pw.paths, path)
+	for name := range pw.files {
+		if !pw.watched(name) {
+			delete(pw.files, name)
+		}
+	}
+	return nil
+}
+
+func (pw *pollWatcher) Close() error {
+	pw.once.Do(func() { close(pw.done) })
+	return nil
+}
+
+// watched return true when name is the path added or in the directory
+func (pw *pollWatcher) watched(name string) bool {
+	if _, ok := pw.paths[name]; ok {
+		return true
+	}
+	_, ok := pw.paths[filepath.Dir(name)]
+	return ok
+}
+
+// scan stat the path, and the files in it when it is a directory
+func (pw *pollWatcher) scan(path string) map[string]*fileState {
+	files := map[string]*fileState{}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return files
+	}
+	files[path] = &fileState{modTime: fi.ModTime(), size: fi.Size(), mode: fi.Mode()}
+	if !fi.IsDir() {
+		return files
+	}
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		pw.error(err)
+		return files
+	}
+	for _, fi := range fis {
+		files[filepath.Join(path, fi.Name())] = &fileState{modTime: fi.ModTime(), size: fi.Size(), mode: fi.Mode()}
+	}
+	return files
+}
+
+func (pw *pollWatcher) loop() {
+	ticker := time.NewTicker(pw.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pw.done:
+			return
+		case <-ticker.C:
+			pw.poll()
+		}
+	}
+}
+
+// poll compare the files with the last state, and send the events
+func (pw *pollWatcher) poll() {
+	pw.mutex.Lock()
+	current := map[string]*fileState{}
+	ops := map[string]fswatcher.Op{}
+	for path, op := range pw.paths {
+		for name, st := range pw.scan(path) {
+			current[name] = st
+			ops[name] = ops[name] | op
+		}
+	}
+	var events []fswatcher.Event
+	for name, st := range current {
+		prev, ok := pw.files[name]
+		if !ok {
+			events = append(events, fswatcher.Event{Name: name, Op: fswatcher.Create})
+			continue
+		}
+		st.hash = prev.hash
+		if st.mode.IsDir() || (st.modTime.Equal(prev.modTime) && st.size == prev.size && st.mode == prev.mode) {
+			continue
+		}
+		op := fswatcher.Chmod
+		if st.size != prev.size || !st.modTime.Equal(prev.modTime) {
+			// the content can be same when only the time is changed. The hash
+			// is computed lazily, so the first change is always a write.
+			h, err := hashFile(name)
+			if err != nil || st.size != prev.size || prev.hash == "" || h != prev.hash {
+				op = fswatcher.Write
+			}
+			st.hash = h
+		}
+		events = append(events, fswatcher.Event{Name: name, Op: op})
+	}
+	for name := range pw.files {
+		if _, ok := current[name]; !ok {
+			events = append(events, fswatcher.Event{Name: name, Op: fswatcher.Remove})
+		}
+	}
+	pw.files = current
+	pw.mutex.Unlock()
+
+	for _, ev := range events {
+		op := ops[ev.Name]
+		if op == 0 {
+			op = fswatcher.All
+		}
+		if ev.Op&op == 0 {
+			continue
+		}
+		select {
+		case pw.events <- ev:
+		case <-pw.done:
+			return
+		}
+	}
+}
+
+func (pw *pollWatcher) error(err error) {
+	select {
+	case pw.errors <- err:
+	default:
+	}
+}